@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/common/utils"
+	"github.com/cloudwego/hertz/pkg/protocol/consts"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/config"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/mapper"
+	"gitlab.aiecnu.net/elion/elion-reading-post/post"
+	"strconv"
+	"time"
+)
+
+type (
+	// DeadLetterFilter 放弃记录的筛选条件, 时间为unix秒, 不指定state时查询已放弃与已丢弃的记录
+	DeadLetterFilter struct {
+		State      *int   `query:"state" json:"state"`
+		HomeworkID string `query:"homework_id" json:"homework_id"`
+		QuestionID string `query:"question_id" json:"question_id"`
+		Stage      string `query:"stage" json:"stage"`
+		Error      string `query:"error" json:"error"`
+		Start      int64  `query:"start" json:"start"`
+		End        int64  `query:"end" json:"end"`
+	}
+	ListDeadLettersReq struct {
+		DeadLetterFilter
+		Page int `query:"page"`
+		Size int `query:"size"`
+	}
+	DiscardDeadLettersReq struct {
+		IDs    []int  `json:"ids"`
+		Reason string `json:"reason"`
+	}
+)
+
+var (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// ListDeadLetters /deadletter/list?page=x&size=x [Get]
+func ListDeadLetters(ctx context.Context, c *app.RequestContext) {
+	var req ListDeadLettersReq
+	if err := c.BindAndValidate(&req); err != nil {
+		c.JSON(consts.StatusOK, utils.H{"message": "param err:" + err.Error()})
+		return
+	}
+	if req.Size <= 0 || req.Size > maxPageSize {
+		req.Size = defaultPageSize
+	}
+	letters, total, err := mapper.GetAbandonMapper().ListDeadLetters(ctx, req.filter(), req.Page, req.Size)
+	if err != nil {
+		c.JSON(consts.StatusOK, utils.H{"message": "list err:" + err.Error()})
+		return
+	}
+	c.JSON(consts.StatusOK, utils.H{"message": "success", "total": total, "items": letters})
+}
+
+// GetDeadLetter /deadletter/get?id=x [Get]
+func GetDeadLetter(ctx context.Context, c *app.RequestContext) {
+	id, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		c.JSON(consts.StatusOK, utils.H{"message": "id format err:" + err.Error()})
+		return
+	}
+	letter, err := mapper.GetAbandonMapper().GetDeadLetter(ctx, id)
+	if errors.Is(err, mapper.NoDeadLetter) {
+		c.JSON(consts.StatusNotFound, utils.H{"message": "dead letter not found"})
+		return
+	} else if err != nil {
+		c.JSON(consts.StatusOK, utils.H{"message": "get err:" + err.Error()})
+		return
+	}
+	c.JSON(consts.StatusOK, utils.H{"message": "success", "item": letter})
+}
+
+// RetryDeadLetters /deadletter/retry [Post]
+// 除state外至少需要一个筛选条件, 避免误操作重试全部记录, 只重试已放弃的记录
+func RetryDeadLetters(ctx context.Context, c *app.RequestContext) {
+	var req DeadLetterFilter
+	if err := c.BindAndValidate(&req); err != nil {
+		c.JSON(consts.StatusOK, utils.H{"message": "param err:" + err.Error()})
+		return
+	}
+	if !req.narrowed() {
+		c.JSON(consts.StatusOK, utils.H{"message": "at least one filter is required"})
+		return
+	}
+	ids, err := post.GetManager(config.GetConfig().Consumers).RetryAbandoned(ctx, req.filter())
+	if err != nil {
+		c.JSON(consts.StatusOK, utils.H{"message": "retry err:" + err.Error()})
+		return
+	}
+	c.JSON(consts.StatusOK, utils.H{"message": "success", "ids": ids})
+}
+
+// DiscardDeadLetters /deadletter/discard [Post]
+func DiscardDeadLetters(ctx context.Context, c *app.RequestContext) {
+	var req DiscardDeadLettersReq
+	if err := c.BindAndValidate(&req); err != nil {
+		c.JSON(consts.StatusOK, utils.H{"message": "param err:" + err.Error()})
+		return
+	}
+	if len(req.IDs) == 0 || req.Reason == "" {
+		c.JSON(consts.StatusOK, utils.H{"message": "ids and reason are required"})
+		return
+	}
+	n, err := post.GetManager(config.GetConfig().Consumers).DiscardAbandoned(ctx, req.IDs, req.Reason)
+	if err != nil {
+		c.JSON(consts.StatusOK, utils.H{"message": "discard err:" + err.Error()})
+		return
+	}
+	c.JSON(consts.StatusOK, utils.H{"message": "success", "discarded": n})
+}
+
+// narrowed 是否有缩小范围的筛选条件, state不缩小重试的范围, 不计入
+func (f *DeadLetterFilter) narrowed() bool {
+	return f.HomeworkID != "" || f.QuestionID != "" || f.Stage != "" || f.Error != "" || f.Start > 0 || f.End > 0
+}
+
+// filter 转换为mapper的筛选条件
+func (f *DeadLetterFilter) filter() *mapper.DeadLetterFilter {
+	filter := &mapper.DeadLetterFilter{
+		State:      f.State,
+		HomeworkID: f.HomeworkID,
+		QuestionID: f.QuestionID,
+		Stage:      f.Stage,
+		Error:      f.Error,
+	}
+	if f.Start > 0 {
+		filter.Start = time.Unix(f.Start, 0)
+	}
+	if f.End > 0 {
+		filter.End = time.Unix(f.End, 0)
+	}
+	return filter
+}
@@ -4,6 +4,8 @@ package handler
 
 import (
 	"context"
+	"encoding/json"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/call"
 	"gitlab.aiecnu.net/elion/elion-reading-post/infra/config"
 	"gitlab.aiecnu.net/elion/elion-reading-post/post"
 	"strconv"
@@ -22,7 +24,7 @@ func Ping(ctx context.Context, c *app.RequestContext) {
 
 // Unabandon /unabandon?id=x [Get]
 func Unabandon(ctx context.Context, c *app.RequestContext) {
-	id, err := strconv.Atoi(c.Param("id"))
+	id, err := strconv.Atoi(c.Query("id"))
 	if err != nil {
 		c.JSON(consts.StatusOK, utils.H{"message": "id format err:" + err.Error()})
 		return
@@ -31,3 +33,129 @@ func Unabandon(ctx context.Context, c *app.RequestContext) {
 		"message": post.GetManager(config.GetConfig().Consumers).Unabandon(id),
 	})
 }
+
+// RecommentReq 重新生成评价的记录
+type RecommentReq struct {
+	IDs []int `json:"ids"`
+}
+
+// Recomment /recomment [Post]
+func Recomment(ctx context.Context, c *app.RequestContext) {
+	var req RecommentReq
+	if err := c.BindAndValidate(&req); err != nil || len(req.IDs) == 0 {
+		c.JSON(consts.StatusOK, utils.H{"message": "ids are required"})
+		return
+	}
+	n, err := post.GetManager(config.GetConfig().Consumers).Recomment(ctx, req.IDs)
+	if err != nil {
+		c.JSON(consts.StatusOK, utils.H{"message": "recomment err:" + err.Error()})
+		return
+	}
+	c.JSON(consts.StatusOK, utils.H{"message": "success", "recomment": n})
+}
+
+// EnqueueReq 上传后需要立即处理的记录
+type EnqueueReq struct {
+	IDs []int `json:"ids"`
+}
+
+// Enqueue /enqueue [Post]
+func Enqueue(ctx context.Context, c *app.RequestContext) {
+	var req EnqueueReq
+	if err := c.BindAndValidate(&req); err != nil || len(req.IDs) == 0 {
+		c.JSON(consts.StatusOK, utils.H{"message": "ids are required"})
+		return
+	}
+	n, err := post.GetManager(config.GetConfig().Consumers).Enqueue(ctx, req.IDs)
+	if err != nil {
+		c.JSON(consts.StatusOK, utils.H{"message": "enqueue err:" + err.Error()})
+		return
+	}
+	c.JSON(consts.StatusOK, utils.H{"message": "success", "enqueue": n})
+}
+
+// ASRCallback /asr/callback [Post]
+// asr服务处理完成后回调, 请求体的callback_data为提交时带签名的任务id
+func ASRCallback(ctx context.Context, c *app.RequestContext) {
+	var body struct {
+		CallbackData string `json:"callback_data"`
+	}
+	if err := json.Unmarshal(c.Request.Body(), &body); err != nil || body.CallbackData == "" {
+		c.JSON(consts.StatusBadRequest, utils.H{"message": "callback_data is required"})
+		return
+	}
+	waiting, err := call.ResolveCallback(body.CallbackData)
+	if err != nil {
+		c.JSON(consts.StatusUnauthorized, utils.H{"message": err.Error()})
+		return
+	} else if !waiting { // 任务已超时转为轮询或由其他实例提交
+		c.JSON(consts.StatusOK, utils.H{"message": "no task waiting"})
+		return
+	}
+	c.JSON(consts.StatusOK, utils.H{"message": "success"})
+}
+
+// Urgent /urgent?id=x [Get]
+func Urgent(ctx context.Context, c *app.RequestContext) {
+	id, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		c.JSON(consts.StatusOK, utils.H{"message": "id format err:" + err.Error()})
+		return
+	}
+	c.JSON(consts.StatusOK, utils.H{
+		"message": post.GetManager(config.GetConfig().Consumers).MarkUrgent(ctx, id),
+	})
+}
+
+// Evaluation /evaluation?id=x [Get]
+func Evaluation(ctx context.Context, c *app.RequestContext) {
+	id, err := strconv.Atoi(c.Query("id"))
+	if err != nil {
+		c.JSON(consts.StatusOK, utils.H{"message": "id format err:" + err.Error()})
+		return
+	}
+	eval, err := post.GetManager(config.GetConfig().Consumers).QueryEvaluation(ctx, id)
+	if err != nil {
+		c.JSON(consts.StatusOK, utils.H{"message": "query err:" + err.Error()})
+		return
+	} else if eval == nil {
+		c.JSON(consts.StatusNotFound, utils.H{"message": "evaluation not found"})
+		return
+	}
+	c.JSON(consts.StatusOK, utils.H{"message": "success", "item": eval})
+}
+
+// Pool /pool [Get]
+func Pool(ctx context.Context, c *app.RequestContext) {
+	c.JSON(consts.StatusOK, post.GetManager(config.GetConfig().Consumers).Status())
+}
+
+// ResizeReq 调整一个阶段的消费者数量
+type ResizeReq struct {
+	Stage string `json:"stage"`
+	Size  int    `json:"size"`
+}
+
+// Resize /resize [Post]
+func Resize(ctx context.Context, c *app.RequestContext) {
+	var req ResizeReq
+	if err := c.BindAndValidate(&req); err != nil || req.Stage == "" {
+		c.JSON(consts.StatusOK, utils.H{"message": "stage and size are required"})
+		return
+	}
+	if _, err := post.GetManager(config.GetConfig().Consumers).Resize(req.Stage, req.Size); err != nil {
+		c.JSON(consts.StatusOK, utils.H{"message": err.Error()})
+		return
+	}
+	c.JSON(consts.StatusOK, post.GetManager(config.GetConfig().Consumers).Status())
+}
+
+// ReloadTemplates /templates/reload [Post]
+func ReloadTemplates(ctx context.Context, c *app.RequestContext) {
+	r, err := call.ReloadTemplates()
+	if err != nil {
+		c.JSON(consts.StatusOK, utils.H{"message": "reload templates err:" + err.Error()})
+		return
+	}
+	c.JSON(consts.StatusOK, utils.H{"message": "success", "templates": r.List()})
+}
@@ -5,6 +5,7 @@ go 1.24.6
 require (
 	github.com/avast/retry-go v3.0.0+incompatible
 	github.com/cloudwego/eino v0.4.4
+	github.com/cloudwego/eino-ext/components/model/deepseek v0.0.0-20250820120452-cb4c949a1d4c
 	github.com/cloudwego/hertz v0.10.2
 	github.com/zeromicro/go-zero v1.9.0
 	go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp v0.62.0
@@ -25,7 +26,6 @@ require (
 	github.com/cenkalti/backoff/v4 v4.3.0 // indirect
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/cloudwego/base64x v0.1.5 // indirect
-	github.com/cloudwego/eino-ext/components/model/deepseek v0.0.0-20250820120452-cb4c949a1d4c // indirect
 	github.com/cloudwego/gopkg v0.1.4 // indirect
 	github.com/cloudwego/netpoll v0.7.0 // indirect
 	github.com/cohesion-org/deepseek-go v1.3.2 // indirect
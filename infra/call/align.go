@@ -0,0 +1,207 @@
+package call
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 通过编辑距离的回溯对齐原文与朗读文本, 得到有序的操作序列
+// 连续的同类错误合并为一处, 偏移为在原文中的字符位置, 多读的内容取其后一个原文单位的位置
+// 按拼音比较时, 同音字的替换不计代价, 声调错误计一半的代价, 使对齐优先匹配读音相近的字
+
+const (
+	OpMatch      = "match"      // 正确
+	OpHomophone  = "homophone"  // 同音字, asr的识别差异, 视为正确
+	OpTone       = "tone"       // 声调错误
+	OpSubstitute = "substitute" // 误读
+	OpInsert     = "insert"     // 多读
+	OpDelete     = "delete"     // 漏读
+)
+
+var (
+	maxDetails  = 20  // 提示词中最多列出的错误处数, 避免读错较多时提示词过长
+	minorWeight = 0.5 // 声调错误在相似度中的权重
+	opNames     = map[string]string{OpHomophone: "同音字", OpTone: "声调错误", OpSubstitute: "替换错误", OpDelete: "遗漏内容", OpInsert: "多余内容"}
+	opCosts     = map[string]int{OpMatch: 0, OpHomophone: 0, OpTone: 1, OpSubstitute: 2} // 插入与删除的代价为2
+)
+
+type (
+	// Edit 一次对齐操作, 合并后的Origin与Reading可能包括多个字或词
+	Edit struct {
+		Op      string `json:"op"`
+		Origin  string `json:"origin,omitempty"`  // 原文内容, 多读时为空
+		Reading string `json:"reading,omitempty"` // 朗读内容, 漏读时为空
+		Offset  int    `json:"offset"`            // 在原文中的字符偏移
+	}
+	// Comparison 原文与朗读文本的比较结果
+	Comparison struct {
+		Language   string  `json:"language"`
+		OriginLen  int     `json:"origin_len"`  // 原文的字数或词数
+		ReadingLen int     `json:"reading_len"` // 朗读的字数或词数
+		Distance   int     `json:"distance"`    // 编辑距离, 不包括同音字与声调错误
+		Minor      int     `json:"minor"`       // 声调错误数
+		Homophones int     `json:"homophones"`  // 同音字数
+		Similarity float64 `json:"similarity"`  // 相似度(0-100)
+		Edits      []Edit  `json:"-"`           // 逐个单位的操作序列, 包括正确的部分
+	}
+)
+
+// Compare 按语言切分后对齐原文与朗读文本, pinyin为true时中文按拼音比较
+func Compare(origin, reading, lang string, pinyin bool) *Comparison {
+	relate := Exact
+	if pinyin && lang != LangEN {
+		relate = Homophone
+	}
+	o, r := tokenize(origin, lang), tokenize(reading, lang)
+	c := &Comparison{Language: lang, OriginLen: len(o), ReadingLen: len(r), Edits: Align(o, r, len([]rune(origin)), relate)}
+	for _, e := range c.Edits {
+		switch e.Op {
+		case OpMatch:
+		case OpHomophone:
+			c.Homophones++
+		case OpTone:
+			c.Minor++
+		default:
+			c.Distance++
+		}
+	}
+	c.Similarity = 100.0
+	if maxLen := max(len(o), len(r)); maxLen > 0 {
+		c.Similarity = 100.0 * (1.0 - (float64(c.Distance)+minorWeight*float64(c.Minor))/float64(maxLen))
+	}
+	return c
+}
+
+// Align 计算编辑距离矩阵并回溯出操作序列, end为原文的字符数, 作为末尾多读内容的偏移
+// relate判断两个单位的关系, 代价相同时依次选择对应, 漏读, 多读, 使对齐结果中正确的部分尽可能多
+func Align(origin, reading []Token, end int, relate func(a, b string) string) []Edit {
+	lenO, lenR := len(origin), len(reading)
+	ops, matrix := make([][]string, lenO+1), make([][]int, lenO+1)
+	for i := 0; i <= lenO; i++ {
+		ops[i], matrix[i] = make([]string, lenR+1), make([]int, lenR+1)
+		matrix[i][0] = 2 * i
+	}
+	for j := 0; j <= lenR; j++ {
+		matrix[0][j] = 2 * j
+	}
+	for i := 1; i <= lenO; i++ {
+		for j := 1; j <= lenR; j++ {
+			ops[i][j] = relate(origin[i-1].Text, reading[j-1].Text)
+			matrix[i][j] = min(
+				matrix[i-1][j]+2,                    // 漏读
+				matrix[i][j-1]+2,                    // 多读
+				matrix[i-1][j-1]+opCosts[ops[i][j]], // 对应
+			)
+		}
+	}
+
+	// 从右下角回溯, 得到逆序的操作
+	edits := make([]Edit, 0, max(lenO, lenR))
+	offset := func(i int) int {
+		if i < lenO {
+			return origin[i].Offset
+		}
+		return end
+	}
+	for i, j := lenO, lenR; i > 0 || j > 0; {
+		switch {
+		case i > 0 && j > 0 && opCosts[ops[i][j]] == 0 && matrix[i][j] == matrix[i-1][j-1]:
+			edits = append(edits, Edit{Op: ops[i][j], Origin: origin[i-1].Text, Reading: reading[j-1].Text, Offset: origin[i-1].Offset})
+			i, j = i-1, j-1
+		case i > 0 && matrix[i][j] == matrix[i-1][j]+2:
+			edits = append(edits, Edit{Op: OpDelete, Origin: origin[i-1].Text, Offset: origin[i-1].Offset})
+			i--
+		case j > 0 && matrix[i][j] == matrix[i][j-1]+2:
+			edits = append(edits, Edit{Op: OpInsert, Reading: reading[j-1].Text, Offset: offset(i)})
+			j--
+		default:
+			edits = append(edits, Edit{Op: ops[i][j], Origin: origin[i-1].Text, Reading: reading[j-1].Text, Offset: origin[i-1].Offset})
+			i, j = i-1, j-1
+		}
+	}
+	for l, r := 0, len(edits)-1; l < r; l, r = l+1, r-1 {
+		edits[l], edits[r] = edits[r], edits[l]
+	}
+	return edits
+}
+
+// Errors 合并连续的同类错误, 不包括正确的部分与同音字
+func (c *Comparison) Errors() []Edit {
+	sep := ""
+	if c.Language == LangEN {
+		sep = " "
+	}
+	var errs []Edit
+	for i, e := range c.Edits {
+		if e.Op == OpMatch || e.Op == OpHomophone {
+			continue
+		}
+		if last := len(errs) - 1; last >= 0 && errs[last].Op == e.Op && c.Edits[i-1].Op == e.Op {
+			errs[last].Origin = join(errs[last].Origin, e.Origin, sep)
+			errs[last].Reading = join(errs[last].Reading, e.Reading, sep)
+			continue
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// Counts 各类错误的字数或词数
+func (c *Comparison) Counts() map[string]int {
+	counts := make(map[string]int)
+	for _, e := range c.Edits {
+		if name, ok := opNames[e.Op]; ok {
+			counts[name]++
+		}
+	}
+	return counts
+}
+
+// String 格式化为提示词中的信息
+func (c *Comparison) String() string {
+	var builder strings.Builder
+	unit := Unit(c.Language)
+	builder.WriteString(fmt.Sprintf("相似度: %.2f%%\n", c.Similarity))
+	builder.WriteString(fmt.Sprintf("编辑距离: %d\n", c.Distance))
+	builder.WriteString(fmt.Sprintf("原文长度: %d %s\n", c.OriginLen, unit))
+	builder.WriteString(fmt.Sprintf("朗读长度: %d %s\n", c.ReadingLen, unit))
+	if c.Homophones > 0 { // 同音字是asr的识别差异, 提示大模型不要作为朗读错误
+		builder.WriteString(fmt.Sprintf("同音字(识别差异, 视为正确): %d %s\n", c.Homophones, unit))
+	}
+	errs := c.Errors()
+	if len(errs) == 0 {
+		builder.WriteString("无错误\n")
+		return builder.String()
+	}
+	counts := c.Counts()
+	for _, op := range []string{OpSubstitute, OpDelete, OpInsert, OpTone} {
+		if n := counts[opNames[op]]; n > 0 {
+			builder.WriteString(fmt.Sprintf("%s: %d %s\n", opNames[op], n, unit))
+		}
+	}
+	builder.WriteString("错误详情:\n")
+	for i, e := range errs {
+		if i == maxDetails {
+			builder.WriteString(fmt.Sprintf("... 另有 %d 处错误\n", len(errs)-maxDetails))
+			break
+		}
+		switch e.Op {
+		case OpSubstitute:
+			builder.WriteString(fmt.Sprintf("原文第%d个字符处 \"%s\" 读成了 \"%s\"\n", e.Offset+1, e.Origin, e.Reading))
+		case OpTone:
+			builder.WriteString(fmt.Sprintf("原文第%d个字符处 \"%s\" 读成了 \"%s\", 只有声调不同\n", e.Offset+1, e.Origin, e.Reading))
+		case OpDelete:
+			builder.WriteString(fmt.Sprintf("原文第%d个字符处 漏读了 \"%s\"\n", e.Offset+1, e.Origin))
+		case OpInsert:
+			builder.WriteString(fmt.Sprintf("原文第%d个字符前 多读了 \"%s\"\n", e.Offset+1, e.Reading))
+		}
+	}
+	return builder.String()
+}
+
+func join(a, b, sep string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+	return a + sep + b
+}
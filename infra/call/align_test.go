@@ -0,0 +1,63 @@
+package call
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	// 开头漏读一个字, 其余部分不应计为替换
+	c := Compare("床前明月光，疑是地上霜。", "前明月光疑是地上霜", LangZH, false)
+	if c.Distance != 1 || !slices.Equal(c.Errors(), []Edit{{Op: OpDelete, Origin: "床", Offset: 0}}) {
+		t.Fatalf("unexpected errors %+v", c.Errors())
+	}
+
+	// 误读, 漏读与多读, 偏移为原文中包括标点的位置
+	c = Compare("床前明月光，疑是地上霜。", "床前明月光疑似地霜啊", LangZH, false)
+	expected := []Edit{
+		{Op: OpSubstitute, Origin: "是", Reading: "似", Offset: 7},
+		{Op: OpDelete, Origin: "上", Offset: 9},
+		{Op: OpInsert, Reading: "啊", Offset: 12},
+	}
+	if !slices.Equal(c.Errors(), expected) {
+		t.Fatalf("unexpected errors %+v", c.Errors())
+	}
+	if counts := c.Counts(); counts["替换错误"] != 1 || counts["遗漏内容"] != 1 || counts["多余内容"] != 1 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+	if info := c.String(); !strings.Contains(info, "原文第8个字符处 \"是\" 读成了 \"似\"") {
+		t.Fatalf("unexpected info %s", info)
+	}
+
+	// 连续的漏读合并为一处, 英文以词为单位
+	c = Compare("The quick brown fox jumps.", "the fox jumps", LangEN, false)
+	if !slices.Equal(c.Errors(), []Edit{{Op: OpDelete, Origin: "quick brown", Offset: 4}}) {
+		t.Fatalf("unexpected errors %+v", c.Errors())
+	}
+	if c = Compare("床前明月光", "床前明月光", LangZH, false); c.Similarity != 100 || len(c.Errors()) != 0 || !strings.Contains(c.String(), "无错误") {
+		t.Fatalf("unexpected comparison %+v", c)
+	}
+}
+
+func TestComparePinyin(t *testing.T) {
+	// 同音字视为正确, 只有声调不同的计为轻微错误, 读音不同的仍为替换
+	c := Compare("我的妈妈在家里", "我地马妈再家离", LangZH, true)
+	expected := []Edit{
+		{Op: OpTone, Origin: "妈", Reading: "马", Offset: 2},
+		{Op: OpTone, Origin: "里", Reading: "离", Offset: 6},
+	}
+	if c.Distance != 0 || c.Homophones != 2 || c.Minor != 2 || !slices.Equal(c.Errors(), expected) {
+		t.Fatalf("unexpected comparison %+v %+v", c, c.Errors())
+	}
+	if info := c.String(); !strings.Contains(info, "同音字(识别差异, 视为正确): 2 字") || !strings.Contains(info, "声调错误: 2 字") {
+		t.Fatalf("unexpected info %s", info)
+	}
+	if c = Compare("我的妈妈", "我和妈妈", LangZH, true); c.Distance != 1 || c.Errors()[0].Op != OpSubstitute {
+		t.Fatalf("unexpected comparison %+v", c)
+	}
+	// 不按拼音比较时同音字为替换
+	if c = Compare("我的妈妈", "我地妈妈", LangZH, false); c.Distance != 1 || c.Homophones != 0 {
+		t.Fatalf("unexpected comparison %+v", c)
+	}
+}
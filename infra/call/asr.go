@@ -1,31 +1,40 @@
 package call
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/avast/retry-go"
 	"github.com/zeromicro/go-zero/core/logx"
 	"gitlab.aiecnu.net/elion/elion-reading-post/infra/config"
-	"net/http"
+	"sync"
 	"time"
 )
 
+// asr服务通过Recognizer接口接入, 由配置中的ASR.Provider选择
+// 各服务的结果统一转换为ASRTaskResp, 原始响应保存在Raw中, 可通过ParseASRTaskResp恢复
+
 var (
-	submitEndpoint = "https://openspeech.bytedance.com/api/v3/auc/bigmodel/submit"
-	queryEndpoint  = "https://openspeech.bytedance.com/api/v3/auc/bigmodel/query"
-	modelName      = "bigmodel"
-	modelVersion   = "400"
-	opts           = []retry.Option{ // 重试策略
+	opts = []retry.Option{ // 重试策略
 		retry.Attempts(uint(5)),             // 最大重试次数
 		retry.DelayType(retry.BackOffDelay), // 指数退避策略
 		retry.MaxDelay(16 * time.Second),    // 最大退避间隔
 		retry.OnRetry(func(n uint, err error) { // 重试日志
 			logx.Infof("[asr file task] retry #%d times with err:%v", n+1, err)
 		})}
-	ASRTaskFailed = errors.New("[asr file task] task failed") // 任务失败
-	queryInterval = 3                                         // 每三秒查询一次
+	ASRTaskFailed   = errors.New("[asr file task] task failed")   // 任务失败
+	ASRSubmitFailed = errors.New("[asr file task] submit failed") // 提交失败
+	recognizer      Recognizer
+	recognizerOnce  sync.Once
 )
 
 type (
+	// Recognizer 语音识别服务, 识别一个音频文件并返回统一的识别结果
+	Recognizer interface {
+		Recognize(ctx context.Context, task *FileAsrTask) (*ASRTaskResp, error)
+		Supports(f *AudioFormat) bool // 是否支持该格式的音频
+	}
 	// Submit 提交请求
 	Submit struct {
 		User         SubmitUser `json:"user"`
@@ -68,7 +77,15 @@ type (
 	}
 	// ASRTaskResp 识别结果
 	ASRTaskResp struct {
-		Result Result `json:"result,omitempty"` // 识别结果，仅当识别成功时填写
+		AudioInfo    AudioInfo       `json:"audio_info,omitempty"` // 音频信息
+		Result       Result          `json:"result,omitempty"`     // 识别结果，仅当识别成功时填写
+		Biased       bool            `json:"-"`                    // 是否使用原文提示
+		Provider     string          `json:"-"`                    // asr服务提供方
+		ModelVersion string          `json:"-"`                    // 模型版本
+		Raw          json.RawMessage `json:"-"`                    // 原始响应
+	}
+	AudioInfo struct {
+		Duration int `json:"duration,omitempty"` // 音频时长(毫秒)
 	}
 	Result struct {
 		Text       string      `json:"text,omitempty"`       // 整个音频的识别结果文本
@@ -78,6 +95,13 @@ type (
 		Text      string `json:"text,omitempty"`       // utterance级的文本内容
 		StartTime int    `json:"start_time,omitempty"` // 起始时间(毫秒)
 		EndTime   int    `json:"end_time,omitempty"`   // 结束时间(毫秒)
+		Words     []Word `json:"words,omitempty"`      // 分词信息
+	}
+	Word struct {
+		Text       string  `json:"text,omitempty"`       // 词的文本内容, 中文为单字
+		StartTime  int     `json:"start_time,omitempty"` // 起始时间(毫秒)
+		EndTime    int     `json:"end_time,omitempty"`   // 结束时间(毫秒)
+		Confidence float64 `json:"confidence,omitempty"` // 置信度, 服务未返回时为0
 	}
 	// FileAsrTask 识别任务
 	FileAsrTask struct {
@@ -88,6 +112,7 @@ type (
 		Rate    int    `json:"rate"`
 		Bits    int    `json:"bits"`
 		Channel int    `json:"channel"`
+		Origin  string `json:"origin,omitempty"` // 朗读的原文, 不为空时用于提示asr
 	}
 )
 
@@ -104,120 +129,52 @@ func NewFileAsrTask(uid, url, format, codec string, rate, bits, channel int) *Fi
 	}
 }
 
-// Submit 提交一个任务
-func (t *FileAsrTask) Submit() (bool, error) {
-	var header http.Header
-	err := retry.Do(func() (err error) {
-		if header, _, err = GetHttpClient().PostWithHeader(submitEndpoint, t.buildHeader(), t.buildSubmit()); err != nil {
-			logx.Errorf("[asr file task]: post err: %s", err)
-			return err
-		}
-		logx.Infof("[asr file task]: log id: %s, status: code %s, message: %s", header.Get("X-Tt-Logid"), header.Get("X-Api-Status-Code"), header.Get("X-Api-Message"))
-		return nil
-	}, opts...)
-	return IsASRSuccess(header.Get("X-Api-Status-Code")), err
-}
-
-// IsASRSuccess 判断是否提交成功
-func IsASRSuccess(code string) bool {
-	return code == "20000000"
+// NewFileAsrTaskWithFormat 使用探测到的格式创建一个文件ASR任务
+func NewFileAsrTaskWithFormat(uid, url string, f *AudioFormat) *FileAsrTask {
+	return NewFileAsrTask(uid, url, f.Format, f.Codec, f.Rate, f.Bits, f.Channel)
 }
 
-// Query 查询结果
-func (t *FileAsrTask) Query() (*ASRTaskResp, error) {
-	query := t.buildHeader()
-	for {
-		var header http.Header
-		var body map[string]any
-		if err := retry.Do(func() (err error) { // 单次请求失败重试
-			if header, body, err = GetHttpClient().PostWithHeader(queryEndpoint, query, nil); err != nil {
-				logx.Errorf("[asr file task] query http err: %s", err)
+// GetRecognizer 根据配置创建asr服务
+func GetRecognizer() Recognizer {
+	recognizerOnce.Do(func() {
+		conf := config.GetConfig().ASR
+		switch conf.Provider {
+		case OpenAIProvider:
+			o := NewOpenAI(conf.OpenAI.BaseURL, conf.OpenAI.ApiKey, conf.OpenAI.Model)
+			o.MaxSize = config.GetConfig().Validate.MaxSize // 与录音校验的大小上限一致
+			recognizer = o
+		case VolcengineProvider:
+			v := NewVolcengine(conf.AppKey, conf.AccessKey)
+			v.Callback = conf.Callback.URL
+			if conf.Callback.Timeout > 0 {
+				v.Timeout = time.Duration(conf.Callback.Timeout) * time.Second
 			}
-			return err
-		}, opts...); err != nil { // 多次请求失败, 可能出现网络问题, 退出
-			logx.Errorf("[asr file task]: query retry too many times err: %s", err)
-			return nil, err
-		}
-		code := header.Get("X-Api-Status-Code")
-		if IsASRSuccess(code) { // 成功
-			return conv2ASRTaskResp(body), nil
-		} else if !t.IsReQuery(code) { // ASR任务失败
-			logx.Errorf("[asr file task]: fail for the reason: %v", body)
-			return nil, ASRTaskFailed
+			if conf.Callback.Poll > 0 {
+				v.Poll = time.Duration(conf.Callback.Poll) * time.Second
+			}
+			SetCallbackSecret(conf.Callback.Secret)
+			recognizer = v
+		default:
+			panic("unknown asr provider: " + conf.Provider)
 		}
-		time.Sleep(time.Duration(queryInterval) * time.Second)
-	}
-}
-
-// IsReQuery 是否需要重新查询
-func (t *FileAsrTask) IsReQuery(code string) bool {
-	return code == "20000001" || code == "20000002"
-}
-
-func (t *FileAsrTask) buildSubmit() *Submit {
-	return &Submit{
-		User: SubmitUser{
-			UID: t.Uid,
-		},
-		Audio: Audio{
-			URL:     t.Url,
-			Format:  t.Format,
-			Codec:   t.Codec,
-			Rate:    t.Rate,
-			Bits:    t.Bits,
-			Channel: t.Channel,
-		},
-		Request: Request{
-			ModelName:    modelName,
-			ModelVersion: modelVersion,
-		},
-	}
-}
-
-func (t *FileAsrTask) buildHeader() http.Header {
-	return http.Header{
-		"X-Api-App-Key":     []string{config.GetConfig().ASR.AppKey},
-		"X-Api-Access-Key":  []string{config.GetConfig().ASR.AccessKey},
-		"X-Api-Resource-Id": []string{"volc.bigasr.auc"},
-		"X-Api-Request-Id":  []string{t.Uid},
-		"X-Api-Sequence":    []string{"-1"},
-	}
+	})
+	return recognizer
 }
 
-func conv2ASRTaskResp(body map[string]any) *ASRTaskResp {
-	var resp ASRTaskResp
-	// 处理result字段
-	if resultVal, ok := body["result"]; ok {
-		if resultMap, ok := resultVal.(map[string]any); ok {
-			// 处理text字段
-			if text, ok := resultMap["text"].(string); ok {
-				resp.Result.Text = text
-			}
-			// 处理utterances字段
-			if utterancesVal, ok := resultMap["utterances"]; ok {
-				if utterancesSlice, ok := utterancesVal.([]any); ok {
-					resp.Result.Utterances = make([]Utterance, 0, len(utterancesSlice))
-					for _, utteranceVal := range utterancesSlice {
-						if utteranceMap, ok := utteranceVal.(map[string]any); ok {
-							utterance := Utterance{}
-							// 处理utterance的text字段
-							if text, ok := utteranceMap["text"].(string); ok {
-								utterance.Text = text
-							}
-							// 处理start_time字段
-							if startTime, ok := utteranceMap["start_time"].(float64); ok {
-								utterance.StartTime = int(startTime)
-							}
-							// 处理end_time字段
-							if endTime, ok := utteranceMap["end_time"].(float64); ok {
-								utterance.EndTime = int(endTime)
-							}
-							resp.Result.Utterances = append(resp.Result.Utterances, utterance)
-						}
-					}
-				}
-			}
+// ParseASRTaskResp 从持久化的原始响应中恢复识别结果
+func ParseASRTaskResp(provider, version string, raw []byte) (resp *ASRTaskResp, err error) {
+	switch provider {
+	case VolcengineProvider:
+		if resp, err = parseVolcQuery(raw); err != nil {
+			return nil, err
+		}
+	case OpenAIProvider:
+		if resp, err = parseTranscription(raw); err != nil {
+			return nil, err
 		}
+	default:
+		return nil, fmt.Errorf("[asr file task] unknown provider: %s", provider)
 	}
-	return &resp
+	resp.Provider, resp.ModelVersion, resp.Raw = provider, version, raw
+	return resp, nil
 }
@@ -0,0 +1,252 @@
+package call
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// noLimit 测试中不读取配置, 使用不限流的限流器
+func noLimit() {
+	limiterOnce.Do(func() {
+		asrLimiter = NewLimiter("asr", 0, 0, 0)
+		commentLimiter = NewLimiter("comment", 0, 0, 0)
+	})
+}
+
+func TestVolcengineRecognize(t *testing.T) {
+	noLimit()
+	var queries int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/submit", func(w http.ResponseWriter, r *http.Request) {
+		var submit Submit
+		if err := json.NewDecoder(r.Body).Decode(&submit); err != nil || submit.Audio.URL != "http://audio/1.mp3" {
+			t.Errorf("unexpected submit: %+v, %v", submit, err)
+		}
+		if r.Header.Get("X-Api-App-Key") != "app" {
+			t.Errorf("unexpected app key: %s", r.Header.Get("X-Api-App-Key"))
+		}
+		w.Header().Set("X-Api-Status-Code", "20000000")
+		_, _ = w.Write([]byte("{}"))
+	})
+	mux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		if queries++; queries < 2 { // 第一次查询时仍在处理中
+			w.Header().Set("X-Api-Status-Code", "20000001")
+			_, _ = w.Write([]byte("{}"))
+			return
+		}
+		w.Header().Set("X-Api-Status-Code", "20000000")
+		_, _ = w.Write([]byte(`{"audio_info":{"duration":1800},"result":{"additions":{"duration":"1800"},"text":"床前明月光","utterances":[{"additions":{"fixed_prefix_result":""},` +
+			`"definite":true,"text":"床前明月光","start_time":100,"end_time":1500,` +
+			`"words":[{"blank_duration":0,"text":"床","start_time":100,"end_time":300,"confidence":0.9},{"text":"前","start_time":300,"end_time":500}]}]}}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	v := NewVolcengine("app", "access")
+	v.SubmitURL, v.QueryURL, v.Interval = srv.URL+"/submit", srv.URL+"/query", 10*time.Millisecond
+	resp, err := v.Recognize(context.Background(), NewFileAsrTask("uid", "http://audio/1.mp3", "mp3", "opus", 16000, 16, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Result.Text != "床前明月光" || len(resp.Result.Utterances) != 1 || resp.Result.Utterances[0].EndTime != 1500 {
+		t.Fatalf("unexpected resp: %+v", resp.Result)
+	}
+	if w := resp.Result.Utterances[0].Words; len(w) != 2 || w[0] != (Word{Text: "床", StartTime: 100, EndTime: 300, Confidence: 0.9}) || resp.AudioInfo.Duration != 1800 {
+		t.Fatalf("unexpected words %+v or audio info %+v", w, resp.AudioInfo)
+	}
+	if resp.Provider != VolcengineProvider || queries != 2 {
+		t.Fatalf("unexpected provider %s or queries %d", resp.Provider, queries)
+	}
+
+	// 从原始响应中恢复
+	parsed, err := ParseASRTaskResp(resp.Provider, resp.ModelVersion, resp.Raw)
+	if err != nil || parsed.Result.Text != resp.Result.Text || len(parsed.Result.Utterances[0].Words) != 2 {
+		t.Fatalf("unexpected parsed: %+v, %v", parsed, err)
+	}
+}
+
+func TestVolcengineCallback(t *testing.T) {
+	noLimit()
+	var queries int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/submit", func(w http.ResponseWriter, r *http.Request) {
+		var submit Submit
+		if err := json.NewDecoder(r.Body).Decode(&submit); err != nil || submit.Callback != "http://post/asr/callback" {
+			t.Errorf("unexpected submit: %+v, %v", submit, err)
+		}
+		w.Header().Set("X-Api-Status-Code", "20000000")
+		_, _ = w.Write([]byte("{}"))
+		if submit.User.UID == "lost" { // 回调丢失
+			return
+		}
+		go func() { // 识别完成后回调, 伪造的回调被拒绝
+			time.Sleep(20 * time.Millisecond)
+			if _, err := ResolveCallback(submit.User.UID + ".forged"); !errors.Is(err, CallbackUnauthorized) {
+				t.Errorf("forged callback should be rejected, got %v", err)
+			}
+			if ok, err := ResolveCallback(submit.CallbackData); !ok || err != nil {
+				t.Errorf("no task waiting for callback, %v", err)
+			}
+		}()
+	})
+	mux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		queries++
+		w.Header().Set("X-Api-Status-Code", "20000000")
+		_, _ = w.Write([]byte(`{"result":{"text":"床前明月光"}}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	v := NewVolcengine("app", "access")
+	v.SubmitURL, v.QueryURL, v.Interval = srv.URL+"/submit", srv.URL+"/query", 10*time.Millisecond
+	v.Callback = "http://post/asr/callback"
+	resp, err := v.Recognize(context.Background(), NewFileAsrTask("uid", "http://audio/1.mp3", "mp3", "opus", 16000, 16, 1))
+	if err != nil || resp.Result.Text != "床前明月光" {
+		t.Fatalf("unexpected resp: %+v, %v", resp, err)
+	}
+	if queries != 1 { // 收到回调后只查询一次
+		t.Fatalf("unexpected queries %d", queries)
+	}
+
+	// 未收到回调时超时后轮询
+	v.Timeout, queries = 20*time.Millisecond, 0
+	if _, err = v.Recognize(context.Background(), NewFileAsrTask("lost", "http://audio/1.mp3", "mp3", "opus", 16000, 16, 1)); err != nil || queries != 1 {
+		t.Fatalf("unexpected queries %d, %v", queries, err)
+	}
+
+	// 回调被转发到其他实例时, 等待期间的低频查询得到结果
+	v.Timeout, v.Poll, queries = time.Hour, 20*time.Millisecond, 0
+	if _, err = v.Recognize(context.Background(), NewFileAsrTask("lost", "http://audio/1.mp3", "mp3", "opus", 16000, 16, 1)); err != nil || queries != 1 {
+		t.Fatalf("unexpected queries %d, %v", queries, err)
+	}
+}
+
+func TestVolcengineDecodeFailed(t *testing.T) {
+	noLimit()
+	var queries int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Api-Status-Code", "20000000")
+		if r.URL.Path == "/query" {
+			queries++
+			_, _ = w.Write([]byte(`{"result":{"text":"床前明月光","utterances":[{"text":"床前明月光","start_time":"100"}]}}`))
+			return
+		}
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	v := NewVolcengine("app", "access")
+	v.SubmitURL, v.QueryURL = srv.URL+"/submit", srv.URL+"/query"
+	if _, err := v.Recognize(context.Background(), NewFileAsrTask("uid", "http://audio/1.mp3", "mp3", "opus", 16000, 16, 1)); !errors.Is(err, DecodeFailed) || queries != 1 {
+		t.Fatalf("unexpected err %v or queries %d", err, queries) // 类型不符时不重试
+	}
+	// 新增的字段与类型不固定的附加信息不影响解析
+	raw := `{"result":{"text":"床前","speaker":1,"additions":{"duration":1200},"utterances":[{"text":"床前","additions":{"fixed":true}}]}}`
+	if resp, err := ParseASRTaskResp(VolcengineProvider, "", []byte(raw)); err != nil || resp.Result.Text != "床前" {
+		t.Fatalf("unknown field should be ignored, got %v", err)
+	}
+}
+
+func TestVolcengineTaskFailed(t *testing.T) {
+	noLimit()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Api-Status-Code", "45000001")
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	v := NewVolcengine("app", "access")
+	v.SubmitURL, v.QueryURL = srv.URL, srv.URL
+	if _, err := v.Recognize(context.Background(), NewFileAsrTask("uid", "http://audio/1.mp3", "mp3", "opus", 16000, 16, 1)); err != ASRSubmitFailed {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
+
+func TestOpenAIRecognize(t *testing.T) {
+	noLimit()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/audio.mp3", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ID3 fake audio"))
+	})
+	mux.HandleFunc("/v1/audio/transcriptions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer key" {
+			t.Errorf("unexpected authorization: %s", r.Header.Get("Authorization"))
+		}
+		if r.FormValue("model") != "whisper-1" || r.FormValue("response_format") != "verbose_json" {
+			t.Errorf("unexpected form: %v", r.Form)
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if audio, _ := io.ReadAll(file); string(audio) != "ID3 fake audio" {
+			t.Errorf("unexpected audio: %s", audio)
+		}
+		_, _ = w.Write([]byte(`{"text":"床前明月光，疑是地上霜","duration":3.2,"segments":[{"text":" 床前明月光","start":0.1,"end":1.5},{"text":"疑是地上霜","start":1.5,"end":3}],` +
+			`"words":[{"word":"床前","start":0.1,"end":0.6},{"word":"明月光","start":0.6,"end":1.5},{"word":"疑是","start":1.5,"end":2}]}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	o := NewOpenAI(srv.URL+"/", "key", "")
+	resp, err := o.Recognize(context.Background(), NewFileAsrTask("uid", srv.URL+"/audio.mp3", "mp3", "opus", 16000, 16, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Result.Text != "床前明月光，疑是地上霜" || len(resp.Result.Utterances) != 2 {
+		t.Fatalf("unexpected resp: %+v", resp.Result)
+	}
+	if u := resp.Result.Utterances[0]; u.Text != "床前明月光" || u.StartTime != 100 || u.EndTime != 1500 || len(u.Words) != 2 {
+		t.Fatalf("unexpected utterance: %+v", u)
+	}
+	if w := resp.Result.Utterances[1].Words; len(w) != 1 || w[0].Text != "疑是" || w[0].EndTime != 2000 || resp.AudioInfo.Duration != 3200 {
+		t.Fatalf("unexpected words %+v or audio info %+v", w, resp.AudioInfo)
+	}
+
+	parsed, err := ParseASRTaskResp(resp.Provider, resp.ModelVersion, resp.Raw)
+	if err != nil || parsed.Result.Text != resp.Result.Text || parsed.ModelVersion != "whisper-1" {
+		t.Fatalf("unexpected parsed: %+v, %v", parsed, err)
+	}
+	if _, err = ParseASRTaskResp(OpenAIProvider, "whisper-1", []byte(`{"text":1}`)); !errors.Is(err, DecodeFailed) {
+		t.Fatalf("expected DecodeFailed, got %v", err)
+	}
+}
+
+func TestOpenAIRetry(t *testing.T) {
+	noLimit()
+	var downloads, queries int
+	status := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusBadRequest}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/audio.mp3", func(w http.ResponseWriter, r *http.Request) {
+		downloads++
+		_, _ = w.Write([]byte("ID3 fake audio"))
+	})
+	mux.HandleFunc("/v1/audio/transcriptions", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status[min(queries, len(status)-1)])
+		queries++
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	// 5xx与429重试, 400不重试
+	o := NewOpenAI(srv.URL+"/", "key", "")
+	_, err := o.Recognize(context.Background(), NewFileAsrTask("uid", srv.URL+"/audio.mp3", "mp3", "opus", 16000, 16, 1))
+	var se *statusError
+	if !errors.As(err, &se) || se.Code != http.StatusBadRequest || queries != 3 {
+		t.Fatalf("unexpected err %v after %d queries", err, queries)
+	}
+
+	// 超过大小上限的音频不重试, 也不提交识别
+	downloads, queries = 0, 0
+	o.MaxSize = 4
+	if _, err = o.Recognize(context.Background(), NewFileAsrTask("uid", srv.URL+"/audio.mp3", "mp3", "opus", 16000, 16, 1)); !errors.Is(err, InvalidAudio) || downloads != 1 || queries != 0 {
+		t.Fatalf("unexpected err %v after %d downloads and %d queries", err, downloads, queries)
+	}
+}
@@ -0,0 +1,121 @@
+package call
+
+import (
+	"cmp"
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// 学生朗读的是已知的原文, 将原文作为上下文提示asr, 减少同音字误识别被计为朗读错误
+// 热词从原文中提取: 书名号与引号中的内容, 英文中句中大写的专有名词, 以及在原文中重复出现的中文词组
+// 各asr服务的提示方式不同, 火山引擎通过Request.Context传入热词与上下文, OpenAI通过prompt传入
+
+var (
+	maxHotwords  = 20  // 最多提取的热词数
+	maxContext   = 800 // 火山引擎上下文的最大字数
+	maxPrompt    = 200 // OpenAI prompt的最大字数, 接口只使用最后224个token
+	quoted       = regexp.MustCompile(`《([^》]{1,20})》|“([^”]{1,10})”|「([^」]{1,10})」|"([^"]{1,20})"`)
+	capitalized  = regexp.MustCompile(`([^.!?\s]\s+)([A-Z][a-zA-Z]+)`)
+	commonHans   = "的了是在我你他她它们这那一不有和也就都着个人上来去说要会到" // 常见字, 包含这些字的词组不作为热词
+	ngramLengths = []int{4, 3, 2}                  // 提取的中文词组长度, 长的优先
+)
+
+type (
+	// volcContext 火山引擎Request.Context的内容, 序列化为json字符串
+	volcContext struct {
+		Hotwords    []volcHotword     `json:"hotwords,omitempty"`
+		ContextType string            `json:"context_type,omitempty"`
+		ContextData []volcContextData `json:"context_data,omitempty"`
+	}
+	volcHotword struct {
+		Word string `json:"word"`
+	}
+	volcContextData struct {
+		Text string `json:"text"`
+	}
+)
+
+// Hotwords 从原文中提取热词
+func Hotwords(origin string) []string {
+	var words []string
+	seen := make(map[string]bool)
+	add := func(w string) {
+		if w = strings.TrimSpace(w); w != "" && !seen[w] && len(words) < maxHotwords {
+			seen[w] = true
+			words = append(words, w)
+		}
+	}
+	for _, m := range quoted.FindAllStringSubmatch(origin, -1) {
+		for _, w := range m[1:] {
+			add(w)
+		}
+	}
+	for _, m := range capitalized.FindAllStringSubmatch(origin, -1) {
+		add(m[2])
+	}
+	for _, w := range repeated(origin) {
+		add(w)
+	}
+	return words
+}
+
+// repeated 在原文中重复出现的中文词组, 按出现次数与长度排序
+// 较短的词组只作为较长词组的一部分出现时不再保留
+func repeated(origin string) []string {
+	counts := make(map[string]int)
+	for _, clause := range strings.FieldsFunc(origin, func(r rune) bool { return !unicode.Is(unicode.Han, r) }) {
+		runes := []rune(clause)
+		for _, n := range ngramLengths {
+			for i := 0; i+n <= len(runes); i++ {
+				if w := string(runes[i : i+n]); !strings.ContainsAny(w, commonHans) {
+					counts[w]++
+				}
+			}
+		}
+	}
+	var words []string
+	for _, n := range ngramLengths {
+		for w, c := range counts {
+			if c < 2 || len([]rune(w)) != n || slices.ContainsFunc(words, func(k string) bool {
+				return strings.Contains(k, w) && counts[k] == c
+			}) {
+				continue
+			}
+			words = append(words, w)
+		}
+	}
+	slices.SortStableFunc(words, func(a, b string) int {
+		return cmp.Or(counts[b]-counts[a], len([]rune(b))-len([]rune(a)), strings.Compare(a, b))
+	})
+	return words
+}
+
+// buildVolcContext 构造火山引擎的热词与上下文
+func buildVolcContext(origin string) string {
+	c := volcContext{ContextType: "dialog_ctx", ContextData: []volcContextData{{Text: truncate(origin, maxContext)}}}
+	for _, w := range Hotwords(origin) {
+		c.Hotwords = append(c.Hotwords, volcHotword{Word: w})
+	}
+	b, _ := json.Marshal(c)
+	return string(b)
+}
+
+// buildPrompt 构造OpenAI的prompt, 先列出热词再附上原文开头
+func buildPrompt(origin string) string {
+	prompt := origin
+	if words := Hotwords(origin); len(words) > 0 {
+		prompt = strings.Join(words, "、") + "。" + origin
+	}
+	return truncate(prompt, maxPrompt)
+}
+
+// truncate 截取前n个字
+func truncate(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n])
+	}
+	return s
+}
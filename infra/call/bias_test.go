@@ -0,0 +1,36 @@
+package call
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestHotwords(t *testing.T) {
+	origin := "《小蝌蚪找妈妈》池塘里有一群小蝌蚪。小蝌蚪游哇游, 过了几天, 小蝌蚪长出了两条后腿。Little Tom met Mary in the park."
+	words := Hotwords(origin)
+	for _, w := range []string{"小蝌蚪找妈妈", "Mary", "小蝌蚪"} {
+		if !slices.Contains(words, w) {
+			t.Fatalf("hotwords %v should contain %s", words, w)
+		}
+	}
+	for _, w := range []string{"蝌蚪", "Little"} { // 只作为更长词组的一部分出现, 或位于句首
+		if slices.Contains(words, w) {
+			t.Fatalf("hotwords %v should not contain %s", words, w)
+		}
+	}
+
+	v := NewVolcengine("app", "access")
+	task := NewFileAsrTask("uid", "http://audio/1.mp3", "mp3", "", 0, 0, 0)
+	if submit := v.buildSubmit(task); submit.Request.Context != "" { // 未提供原文时不提示
+		t.Fatalf("unexpected context %s", submit.Request.Context)
+	}
+	task.Origin = origin
+	var c volcContext
+	if err := json.Unmarshal([]byte(v.buildSubmit(task).Request.Context), &c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Hotwords) != len(words) || c.ContextData[0].Text != origin {
+		t.Fatalf("unexpected context %+v", c)
+	}
+}
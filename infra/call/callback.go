@@ -0,0 +1,96 @@
+package call
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// asr服务以回调模式提交时, 识别任务在callbacks中登记一个等待通道
+// 回调接口收到通知后通过ResolveCallback唤醒等待中的任务, 任务被唤醒后查询一次结果
+// 未登记的回调(如其他实例提交的任务)会被忽略, 等待中的任务按较长的间隔查询结果, 不依赖回调一定到达本实例
+// 提交时的callback_data为任务id与签名, 回调接口只接受签名正确的通知
+
+var (
+	callbacks            = &callbackRegistry{waiting: make(map[string]chan struct{}), secret: randomSecret()}
+	CallbackUnauthorized = errors.New("回调的签名无效")
+)
+
+// callbackRegistry 等待回调的任务, key为提交时的任务id
+type callbackRegistry struct {
+	mu      sync.Mutex
+	waiting map[string]chan struct{}
+	secret  []byte // 签名的密钥, 未配置时使用随机生成的
+}
+
+// await 登记一个等待回调的任务, 返回等待通道与注销函数
+func (r *callbackRegistry) await(uid string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	r.mu.Lock()
+	r.waiting[uid] = ch
+	r.mu.Unlock()
+	return ch, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.waiting[uid] == ch {
+			delete(r.waiting, uid)
+		}
+	}
+}
+
+// resolve 唤醒等待回调的任务, 任务不存在或已被唤醒时返回false
+func (r *callbackRegistry) resolve(uid string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ch, ok := r.waiting[uid]
+	if !ok {
+		return false
+	}
+	delete(r.waiting, uid)
+	ch <- struct{}{}
+	return true
+}
+
+// sign 生成回调数据: 任务id.签名
+func (r *callbackRegistry) sign(uid string) string {
+	mac := hmac.New(sha256.New, r.secret)
+	mac.Write([]byte(uid))
+	return uid + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verify 校验回调数据的签名, 返回任务id
+func (r *callbackRegistry) verify(data string) (string, bool) {
+	i := strings.LastIndex(data, ".")
+	if i < 0 {
+		return "", false
+	}
+	uid := data[:i]
+	return uid, hmac.Equal([]byte(r.sign(uid)), []byte(data))
+}
+
+// SetCallbackSecret 设置回调签名的密钥, 多个实例应配置相同的密钥
+func SetCallbackSecret(secret string) {
+	if secret != "" {
+		callbacks.secret = []byte(secret)
+	}
+}
+
+// ResolveCallback 由回调接口调用, data为提交时的callback_data, 签名无效时返回CallbackUnauthorized
+// 返回是否有任务在等待
+func ResolveCallback(data string) (bool, error) {
+	uid, ok := callbacks.verify(data)
+	if !ok {
+		return false, CallbackUnauthorized
+	}
+	return callbacks.resolve(uid), nil
+}
+
+func randomSecret() []byte {
+	secret := make([]byte, 32)
+	_, _ = rand.Read(secret)
+	return secret
+}
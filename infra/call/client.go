@@ -2,7 +2,9 @@ package call
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/zeromicro/go-zero/core/logx"
 	"io"
@@ -12,10 +14,12 @@ import (
 
 // httpx/client 是一个简单的http客户端
 // 支持流式与非流式请求, 通过StreamReader包装流式请求的响应
+// 非流式请求的响应可以解析为map, 也可以通过ReqAs解析为指定的类型, 类型不符时返回DecodeFailed
 
 var (
-	client *HttpClient
-	once   sync.Once
+	client       *HttpClient
+	once         sync.Once
+	DecodeFailed = errors.New("[httpx] 响应体与期望的类型不符")
 )
 
 // HttpClient 是一个简单的 HTTP 客户端
@@ -37,8 +41,8 @@ func GetHttpClient() *HttpClient {
 	return NewHttpClient()
 }
 
-// do 发送请求
-func (c *HttpClient) do(method, url string, headers http.Header, body any) (resp *http.Response, err error) {
+// do 发送请求, ctx取消时中断请求
+func (c *HttpClient) do(ctx context.Context, method, url string, headers http.Header, body any) (resp *http.Response, err error) {
 	// 序列化 body 为 JSON
 	var bodyBytes []byte
 	var req *http.Request
@@ -46,7 +50,7 @@ func (c *HttpClient) do(method, url string, headers http.Header, body any) (resp
 		return nil, fmt.Errorf("[httpx]请求体序列化失败: %w", err)
 	}
 	// 创建新的请求
-	if req, err = http.NewRequest(method, url, bytes.NewBuffer(bodyBytes)); err != nil {
+	if req, err = http.NewRequestWithContext(ctx, method, url, bytes.NewBuffer(bodyBytes)); err != nil {
 		return nil, fmt.Errorf("创建请求失败: %w", err)
 	}
 	// 设置请求头
@@ -57,9 +61,10 @@ func (c *HttpClient) do(method, url string, headers http.Header, body any) (resp
 	return c.Client.Do(req)
 }
 
-func (c *HttpClient) ReqWithHeader(method, url string, headers http.Header, body any) (header http.Header, resp map[string]any, err error) {
+// exchange 发送请求并读取响应体, 非2xx的状态码视为失败
+func (c *HttpClient) exchange(ctx context.Context, method, url string, headers http.Header, body any) (header http.Header, raw []byte, err error) {
 	var response *http.Response
-	if response, err = c.do(method, url, headers, body); err != nil {
+	if response, err = c.do(ctx, method, url, headers, body); err != nil {
 		return nil, nil, fmt.Errorf("[httpx] 发送请求失败: %w", err)
 	}
 	defer func() {
@@ -73,46 +78,85 @@ func (c *HttpClient) ReqWithHeader(method, url string, headers http.Header, body
 		return response.Header, nil, fmt.Errorf("unexpected status code: %d, response body: %s", response.StatusCode, _resp)
 	}
 	// 读取响应体
-	var _resp []byte
-	if _resp, err = io.ReadAll(response.Body); err != nil {
+	if raw, err = io.ReadAll(response.Body); err != nil {
 		return response.Header, nil, fmt.Errorf("读取响应失败: %w", err)
 	}
+	return response.Header, raw, nil
+}
+
+func (c *HttpClient) ReqWithHeader(ctx context.Context, method, url string, headers http.Header, body any) (header http.Header, resp map[string]any, err error) {
+	var raw []byte
+	if header, raw, err = c.exchange(ctx, method, url, headers, body); err != nil {
+		return header, nil, err
+	}
 	// 反序列化响应体
-	if err = json.Unmarshal(_resp, &resp); err != nil {
-		return response.Header, nil, fmt.Errorf("反序列化响应失败: %w", err)
+	if err = json.Unmarshal(raw, &resp); err != nil {
+		return header, nil, fmt.Errorf("反序列化响应失败: %w", err)
+	}
+	return header, resp, nil
+}
+
+// ReqAs 非流式HTTP请求, 响应体解析为T, 同时返回原始响应体
+// 方法不能有类型参数, 因此以函数的形式提供
+func ReqAs[T any](ctx context.Context, c *HttpClient, method, url string, headers http.Header, body any) (header http.Header, resp *T, raw []byte, err error) {
+	if header, raw, err = c.exchange(ctx, method, url, headers, body); err != nil {
+		return header, nil, nil, err
+	}
+	resp, err = Decode[T](raw)
+	return header, resp, raw, err
+}
+
+// PostAs 非流式Post, 响应体解析为T
+func PostAs[T any](ctx context.Context, c *HttpClient, url string, headers http.Header, body any) (http.Header, *T, []byte, error) {
+	return ReqAs[T](ctx, c, "POST", url, headers, body)
+}
+
+// Decode 解析json, 类型不符或有多余内容时返回DecodeFailed, 空内容解析为零值
+// T中未定义的字段直接忽略, 避免服务新增字段后已付费的结果与持久化的原始响应无法解析
+func Decode[T any](raw []byte) (*T, error) {
+	resp := new(T)
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return resp, nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if err := decoder.Decode(resp); err != nil {
+		return nil, fmt.Errorf("%w: %w", DecodeFailed, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: unexpected data after offset %d", DecodeFailed, decoder.InputOffset())
 	}
-	return response.Header, resp, nil
+	return resp, nil
 }
 
 // Req 非流式HTTP请求
-func (c *HttpClient) Req(method, url string, headers http.Header, body any) (resp map[string]any, err error) {
-	_, resp, err = c.ReqWithHeader(method, url, headers, body)
+func (c *HttpClient) Req(ctx context.Context, method, url string, headers http.Header, body any) (resp map[string]any, err error) {
+	_, resp, err = c.ReqWithHeader(ctx, method, url, headers, body)
 	return resp, err
 }
 
 // GetWithHeader 非流式Get, 返回请求头
-func (c *HttpClient) GetWithHeader(url string, headers http.Header, body any) (header http.Header, resp map[string]any, err error) {
-	return c.ReqWithHeader("GET", url, headers, body)
+func (c *HttpClient) GetWithHeader(ctx context.Context, url string, headers http.Header, body any) (header http.Header, resp map[string]any, err error) {
+	return c.ReqWithHeader(ctx, "GET", url, headers, body)
 }
 
 // Get 非流式Get
-func (c *HttpClient) Get(url string, headers http.Header, body any) (resp map[string]any, err error) {
-	return c.Req("GET", url, headers, body)
+func (c *HttpClient) Get(ctx context.Context, url string, headers http.Header, body any) (resp map[string]any, err error) {
+	return c.Req(ctx, "GET", url, headers, body)
 }
 
 // PostWithHeader 非流式Post, 返回请求头
-func (c *HttpClient) PostWithHeader(url string, headers http.Header, body any) (header http.Header, resp map[string]any, err error) {
-	return c.ReqWithHeader("POST", url, headers, body)
+func (c *HttpClient) PostWithHeader(ctx context.Context, url string, headers http.Header, body any) (header http.Header, resp map[string]any, err error) {
+	return c.ReqWithHeader(ctx, "POST", url, headers, body)
 }
 
 // Post 非流式Post
-func (c *HttpClient) Post(url string, headers http.Header, body any) (resp map[string]any, err error) {
-	return c.Req("POST", url, headers, body)
+func (c *HttpClient) Post(ctx context.Context, url string, headers http.Header, body any) (resp map[string]any, err error) {
+	return c.Req(ctx, "POST", url, headers, body)
 }
 
 // StreamWithHeader 流式HTTP请求. 返回请求头
-func (c *HttpClient) StreamWithHeader(method, url string, headers http.Header, body interface{}) (http.Header, *StreamReader, error) {
-	resp, err := c.do(method, url, headers, body)
+func (c *HttpClient) StreamWithHeader(ctx context.Context, method, url string, headers http.Header, body interface{}) (http.Header, *StreamReader, error) {
+	resp, err := c.do(ctx, method, url, headers, body)
 	if err != nil {
 		return nil, nil, fmt.Errorf("发送请求失败: %w", err)
 	}
@@ -130,29 +174,29 @@ func (c *HttpClient) StreamWithHeader(method, url string, headers http.Header, b
 }
 
 // Stream 流式HTTP请求
-func (c *HttpClient) Stream(method, url string, headers http.Header, body interface{}) (*StreamReader, error) {
-	_, reader, err := c.StreamWithHeader(method, url, headers, body)
+func (c *HttpClient) Stream(ctx context.Context, method, url string, headers http.Header, body interface{}) (*StreamReader, error) {
+	_, reader, err := c.StreamWithHeader(ctx, method, url, headers, body)
 	return reader, err
 }
 
 // StreamGetWithHeader 流式Get请求, 返回请求头
-func (c *HttpClient) StreamGetWithHeader(url string, headers http.Header, body any) (http.Header, *StreamReader, error) {
-	return c.StreamWithHeader("GET", url, headers, body)
+func (c *HttpClient) StreamGetWithHeader(ctx context.Context, url string, headers http.Header, body any) (http.Header, *StreamReader, error) {
+	return c.StreamWithHeader(ctx, "GET", url, headers, body)
 }
 
 // StreamGet 流式Get请求
-func (c *HttpClient) StreamGet(url string, headers http.Header, body any) (*StreamReader, error) {
-	return c.Stream("GET", url, headers, body)
+func (c *HttpClient) StreamGet(ctx context.Context, url string, headers http.Header, body any) (*StreamReader, error) {
+	return c.Stream(ctx, "GET", url, headers, body)
 }
 
 // StreamPostWithHeader 流式Post请求, 返回请求头
-func (c *HttpClient) StreamPostWithHeader(url string, headers http.Header, body any) (http.Header, *StreamReader, error) {
-	return c.StreamWithHeader("POST", url, headers, body)
+func (c *HttpClient) StreamPostWithHeader(ctx context.Context, url string, headers http.Header, body any) (http.Header, *StreamReader, error) {
+	return c.StreamWithHeader(ctx, "POST", url, headers, body)
 }
 
 // StreamPost 流式Post请求
-func (c *HttpClient) StreamPost(url string, headers http.Header, body any) (*StreamReader, error) {
-	return c.Stream("POST", url, headers, body)
+func (c *HttpClient) StreamPost(ctx context.Context, url string, headers http.Header, body any) (*StreamReader, error) {
+	return c.Stream(ctx, "POST", url, headers, body)
 }
 
 // StreamReader 流式请求Reader, 封装是为了避免只返回reader时无法关闭resp.Body
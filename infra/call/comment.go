@@ -4,88 +4,171 @@ import (
 	"errors"
 	"fmt"
 	"github.com/cloudwego/eino-ext/components/model/deepseek"
-	"github.com/cloudwego/eino/components/prompt"
 	"github.com/cloudwego/eino/schema"
 	"github.com/zeromicro/go-zero/core/logx"
 	"gitlab.aiecnu.net/elion/elion-reading-post/infra/config"
 	"golang.org/x/net/context"
+	"strconv"
 	"strings"
+	"sync"
 	"unicode/utf8"
 )
 
-func init() {
-	var err error
-	if commentModel, err = deepseek.NewChatModel(nil, &deepseek.ChatModelConfig{
-		Model:   "deepseek-v3-250324",
-		APIKey:  config.GetConfig().Comment.ApiKey,
-		BaseURL: config.GetConfig().Comment.BaseURL,
-	}); err != nil {
-		panic("create comment model err:" + err.Error())
-	}
+// initComment 首次使用时根据配置创建评论模型
+func initComment() {
+	commentOnce.Do(func() {
+		var err error
+		if commentModel, err = deepseek.NewChatModel(nil, &deepseek.ChatModelConfig{
+			Model:   "deepseek-v3-250324",
+			APIKey:  config.GetConfig().Comment.ApiKey,
+			BaseURL: config.GetConfig().Comment.BaseURL,
+		}); err != nil {
+			panic("create comment model err:" + err.Error())
+		}
+	})
 }
 
 var (
-	// 评论提示词模板
-	commentPrompt = prompt.FromMessages(schema.FString,
-		schema.AssistantMessage(config.GetConfig().Comment.Assistant, nil),
-		schema.UserMessage(config.GetConfig().Comment.Template))
-	commentModel *deepseek.ChatModel
-	NoReasoning  = errors.New("无有效内容")
+	commentModel     *deepseek.ChatModel
+	commentOnce      sync.Once
+	completionTokens = 500 // 预估的评语token数, 用于tpm限流
+	NoReasoning      = errors.New("无有效内容")
 )
 
 // CommentTask 评价任务
 type CommentTask struct {
-	id      int
-	origin  string // 原文
-	reading string // 学生朗读
-	resp    *schema.Message
+	id         int
+	origin     string      // 原文
+	reading    string      // 学生朗读
+	language   string      // 原文语言, 决定比较单位与提示词
+	comparison *Comparison // 与原文的比较结果, 为空时提交前计算
+	fluency    *Fluency    // 流利度, 为空时不提供给大模型
+	template   *Template   // 提示词模板, 为空时提交前按id分配
+	resp       *schema.Message
+	feedback   *Feedback // 解析后的评语
 }
 
-// NewCommentTask 创建评价任务
+// NewCommentTask 创建评价任务, 语言根据原文检测
 func NewCommentTask(id int, origin, reading string) *CommentTask {
-	return &CommentTask{id: id, origin: origin, reading: reading}
+	return &CommentTask{id: id, origin: origin, reading: reading, language: DetectLanguage(origin)}
 }
 
-// Submit 提交评价任务
-func (t *CommentTask) Submit() (ok bool, err error) {
-	similarity := t.similarity() // 计算相似度
-	var msgs []*schema.Message   // 构造提示词
-	if msgs, err = commentPrompt.Format(context.Background(), formatInfos(t.origin, t.reading, similarity)); err != nil {
-		return false, err
+// WithLanguage 指定原文语言, 为空时保留检测结果
+func (t *CommentTask) WithLanguage(lang string) *CommentTask {
+	t.language = Language(lang, t.origin)
+	return t
+}
+
+// WithComparison 使用已计算的比较结果, 需与任务的语言一致
+func (t *CommentTask) WithComparison(c *Comparison) *CommentTask {
+	t.comparison = c
+	return t
+}
+
+// WithFluency 将流利度指标提供给大模型
+func (t *CommentTask) WithFluency(f *Fluency) *CommentTask {
+	t.fluency = f
+	return t
+}
+
+// WithTemplate 使用指定的提示词模板
+func (t *CommentTask) WithTemplate(tpl *Template) *CommentTask {
+	t.template = tpl
+	return t
+}
+
+// Template 使用的提示词模板, 提交前为空时返回nil
+func (t *CommentTask) Template() *Template {
+	return t.template
+}
+
+// Submit 提交评价任务, ctx取消时停止等待限流与生成
+func (t *CommentTask) Submit(ctx context.Context) (ok bool, err error) {
+	initComment()
+	if t.comparison == nil { // 对齐原文与朗读文本
+		t.comparison = Compare(t.origin, t.reading, t.language, false)
 	}
-	if t.resp, err = commentModel.Generate(context.Background(), msgs); err != nil {
-		logx.Errorf("[comment] generate err:%v", err)
+	if t.template == nil {
+		if t.template = GetTemplates().Pick(t.language, strconv.Itoa(t.id)); t.template == nil {
+			return false, NoTemplate
+		}
+	}
+	var msgs []*schema.Message // 构造提示词, 并要求以json输出
+	if msgs, err = t.template.chat.Format(ctx, formatInfos(t.origin, t.reading, t.comparison, t.fluency)); err != nil {
 		return false, err
 	}
-	return true, nil
+	msgs = append(msgs, schema.SystemMessage(feedbackFormat))
+
+	// 回复无效或未通过检查时将原因反馈给大模型重新生成, 次数用尽后使用兜底的评语
+	guard := GetGuard()
+	for attempt := 1; ; attempt++ {
+		if t.resp, err = generate(ctx, msgs); err != nil {
+			logx.Errorf("[comment] generate err:%v", err)
+			return false, err
+		}
+		if t.feedback, err = ParseFeedback(t.resp.Content, t.origin); err == nil {
+			if err = guard.Check(t.feedback, guard.ScriptOf(t.language, t.template)); err == nil {
+				return true, nil
+			}
+		}
+		logx.Errorf("[comment] task %d attempt %d invalid feedback: %v", t.id, attempt, err)
+		if attempt >= config.GetConfig().Comment.Attempts {
+			logx.Errorf("[comment] task %d use fallback comment", t.id)
+			t.feedback = guard.Safe()
+			return true, nil
+		}
+		msgs = append(msgs, schema.AssistantMessage(t.resp.Content, nil),
+			schema.UserMessage(fmt.Sprintf("回复不符合要求(%v), 请按格式重新输出json", err)))
+	}
 }
 
-// Query 获取评价结果
-func (t *CommentTask) Query() (string, error) {
-	logx.Infof("[comment task] id: %d comment success | Tokens used: %d (prompt) + %d (completion) = %d (total)",
-		t.id, t.resp.ResponseMeta.Usage.PromptTokens, t.resp.ResponseMeta.Usage.CompletionTokens, t.resp.ResponseMeta.Usage.TotalTokens)
-	return t.resp.Content, nil
+// generate 调用评论模型
+// 调用前等待大模型限流器的配额, tpm按提示词长度预估, 调用后按实际用量修正
+func generate(ctx context.Context, msgs []*schema.Message) (*schema.Message, error) {
+	limiter, estimated := CommentLimiter(), estimateTokens(msgs)
+	if err := limiter.WaitTokens(ctx, estimated); err != nil {
+		return nil, err
+	}
+	release, err := limiter.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err = limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	resp, err := commentModel.Generate(ctx, msgs)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ResponseMeta != nil && resp.ResponseMeta.Usage != nil {
+		limiter.Adjust(estimated, resp.ResponseMeta.Usage.TotalTokens)
+	}
+	return resp, nil
+}
+
+// estimateTokens 按字符数预估一次调用的token数
+func estimateTokens(msgs []*schema.Message) int {
+	n := completionTokens
+	for _, msg := range msgs {
+		n += utf8.RuneCountInString(msg.Content)
+	}
+	return n
 }
 
-// similarity 计算朗读文本与原文的相似度
-// 返回相似度百分比(0-100)和详细的错误分析
-func (t *CommentTask) similarity() map[string]any {
-	// 预处理文本：去除标点符号和空白字符，统一为小写（如果是英文）
-	origin, reading := cleanText(t.origin), cleanText(t.reading)
-	// 计算编辑距离
-	distance := calculateEditDistance(origin, reading)
-	maxLen := max(utf8.RuneCountInString(origin), utf8.RuneCountInString(reading))
-	// 计算相似度百分比
-	similarity := 100.0 * (1.0 - float64(distance)/float64(maxLen))
-	// 错误分析
-	e := analyzeErrors(origin, reading)
-	return map[string]any{
-		"相似度":  similarity,
-		"编辑距离": distance,
-		"错误分析": e,
-		"原文长度": utf8.RuneCountInString(origin),
-		"朗读长度": utf8.RuneCountInString(reading),
+// Query 获取结构化的评价结果
+func (t *CommentTask) Query() (*Feedback, error) {
+	if t.feedback == nil {
+		return nil, NoReasoning
+	}
+	if t.resp != nil && t.resp.ResponseMeta != nil && t.resp.ResponseMeta.Usage != nil { // 部分服务不返回用量
+		logx.Infof("[comment task] id: %d comment success | Tokens used: %d (prompt) + %d (completion) = %d (total)",
+			t.id, t.resp.ResponseMeta.Usage.PromptTokens, t.resp.ResponseMeta.Usage.CompletionTokens, t.resp.ResponseMeta.Usage.TotalTokens)
+	} else {
+		logx.Infof("[comment task] id: %d comment success", t.id)
 	}
+	return t.feedback, nil
 }
 
 // 中文常见标点符号集合
@@ -114,81 +197,14 @@ func cleanText(text string) string {
 	}, text)
 }
 
-// calculateEditDistance 计算编辑距离（Levenshtein距离）
-func calculateEditDistance(a, b string) int {
-	runeA, runeB := []rune(a), []rune(b)
-	lenA, lenB := len(runeA), len(runeB)
-
-	// 创建二维数组存储编辑距离
-	matrix := make([][]int, lenA+1)
-	for i := 0; i <= lenA; i++ {
-		matrix[i] = make([]int, lenB+1)
-		matrix[i][0] = i
-	}
-	for j := 0; j <= lenB; j++ {
-		matrix[0][j] = j
-	}
-
-	// 计算编辑距离
-	for i := 1; i <= lenA; i++ {
-		for j := 1; j <= lenB; j++ {
-			cost := 0
-			if runeA[i-1] != runeB[j-1] {
-				cost = 1
-			}
-			matrix[i][j] = min(
-				matrix[i-1][j]+1,      // 删除
-				matrix[i][j-1]+1,      // 插入
-				matrix[i-1][j-1]+cost, // 替换
-			)
-		}
-	}
-	return matrix[lenA][lenB]
-}
-
-// analyzeErrors 分析错误类型
-func analyzeErrors(origin, reading string) map[string]int {
-	runeO, runeR, e := []rune(origin), []rune(reading), make(map[string]int)
-
-	// 使用动态规划回溯路径找出具体错误
-	i, j := len(runeO), len(runeR)
-	matrix := make([][]int, i+1)
-	for x := 0; x <= i; x++ {
-		matrix[x] = make([]int, j+1)
-	}
-
-	// 这里简化的错误分析, 只统计增删改的次数，后续可以使用更复杂的算法
-	minLen := min(i, j)
-	for k := 0; k < minLen; k++ {
-		if runeO[k] != runeR[k] {
-			e["替换错误"]++
-		}
-	}
-	if i > j {
-		e["遗漏内容"] += i - j
-	} else if j > i {
-		e["多余内容"] += j - i
-	}
-	return e
-}
-
 // 格式化信息以填充prompt模板
-func formatInfos(origin, reading string, result map[string]any) map[string]any {
+func formatInfos(origin, reading string, comparison *Comparison, fluency *Fluency) map[string]any {
 	var builder strings.Builder
-	// 基本信息
-	builder.WriteString(fmt.Sprintf("相似度: %.2f%%\n", result["相似度"]))
-	builder.WriteString(fmt.Sprintf("编辑距离: %d\n", result["编辑距离"]))
-	builder.WriteString(fmt.Sprintf("原文长度: %d 字符\n", result["原文长度"]))
-	builder.WriteString(fmt.Sprintf("朗读长度: %d 字符\n", result["朗读长度"]))
-	// 错误分析
-	if e, ok := result["错误分析"].(map[string]int); ok {
-		if len(e) == 0 {
-			builder.WriteString("无错误\n")
-		} else {
-			for typ, v := range e {
-				builder.WriteString(fmt.Sprintf("%s: %d 处\n", typ, v))
-			}
-		}
+	// 相似度与错误分析
+	builder.WriteString(comparison.String())
+	// 流利度
+	if fluency != nil {
+		builder.WriteString(fluency.String())
 	}
 	return map[string]any{"origin": origin, "reading": reading, "info": builder.String()}
 }
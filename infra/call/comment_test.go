@@ -9,6 +9,7 @@ import (
 )
 
 func TestDeepseek(t *testing.T) {
+	initComment()
 	msgs, err := prompt.FromMessages(schema.FString, schema.UserMessage("你好")).Format(context.Background(), nil)
 	if err != nil {
 		t.Fatal(err)
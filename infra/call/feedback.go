@@ -0,0 +1,119 @@
+package call
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// 评语要求大模型按固定的结构以json输出, 便于客户端分别展示优点, 问题与建议
+// 回复先做简单的修复(去除代码块标记与json之外的内容, 多余的逗号), 再校验字段
+// 修复后仍无效时, 将错误原因反馈给大模型重新生成
+
+type (
+	// Feedback 结构化的评语
+	Feedback struct {
+		Summary       string   `json:"summary"`            // 总体评价
+		Strengths     []string `json:"strengths"`          // 优点
+		Issues        []Issue  `json:"issues"`             // 问题
+		Suggestions   []string `json:"suggestions"`        // 改进建议
+		Encouragement string   `json:"encouragement"`      // 鼓励的话
+		Fallback      bool     `json:"fallback,omitempty"` // 是否为未通过检查时使用的兜底评语
+	}
+	// Issue 朗读中的一个问题, Quote为引用的原文内容
+	Issue struct {
+		Quote   string `json:"quote"`
+		Problem string `json:"problem"`
+	}
+)
+
+var (
+	maxItems        = 5 // 每个列表最多保留的条数
+	trailingCommas  = regexp.MustCompile(`,\s*([}\]])`)
+	InvalidFeedback = errors.New("评语不符合格式")
+	// feedbackFormat 追加在提示词之后, 说明输出的格式, 不经过模板格式化, 可以包括花括号
+	feedbackFormat = `请只输出一个json对象, 不要输出其他内容, 格式如下:
+{
+  "summary": "对本次朗读的总体评价",
+  "strengths": ["做得好的地方"],
+  "issues": [{"quote": "出现问题的原文内容, 必须原样摘自原文", "problem": "问题的说明"}],
+  "suggestions": ["具体的改进建议"],
+  "encouragement": "鼓励学生的话"
+}
+strengths, issues, suggestions 各不超过5条, 没有时为空数组`
+)
+
+// ParseFeedback 修复并解析大模型的回复, 丢弃引用内容不在原文中的问题
+func ParseFeedback(content, origin string) (*Feedback, error) {
+	content = strings.TrimSpace(content)
+	start, end := strings.Index(content, "{"), strings.LastIndex(content, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("%w: 回复中没有json对象", InvalidFeedback)
+	}
+	content = trailingCommas.ReplaceAllString(content[start:end+1], "$1")
+	var f Feedback
+	if err := json.Unmarshal([]byte(content), &f); err != nil {
+		return nil, fmt.Errorf("%w: %w", InvalidFeedback, err)
+	}
+
+	f.Summary, f.Encouragement = strings.TrimSpace(f.Summary), strings.TrimSpace(f.Encouragement)
+	f.Strengths, f.Suggestions = compact(f.Strengths), compact(f.Suggestions)
+	issues := f.Issues[:0]
+	for _, issue := range f.Issues {
+		issue.Quote, issue.Problem = strings.TrimSpace(issue.Quote), strings.TrimSpace(issue.Problem)
+		if issue.Problem == "" || (issue.Quote != "" && origin != "" && !strings.Contains(origin, issue.Quote)) {
+			continue
+		}
+		issues = append(issues, issue)
+	}
+	f.Issues = issues[:min(len(issues), maxItems)]
+	if f.Summary == "" {
+		return nil, fmt.Errorf("%w: 缺少summary", InvalidFeedback)
+	} else if len(f.Strengths)+len(f.Issues)+len(f.Suggestions) == 0 {
+		return nil, fmt.Errorf("%w: strengths, issues, suggestions都为空", InvalidFeedback)
+	}
+	return &f, nil
+}
+
+// String 展开为纯文本, 写入答案表的comment
+func (f *Feedback) String() string {
+	var builder strings.Builder
+	builder.WriteString(f.Summary)
+	section := func(title string, items []string) {
+		if len(items) == 0 {
+			return
+		}
+		builder.WriteString("\n" + title + ":")
+		for i, item := range items {
+			builder.WriteString(fmt.Sprintf("\n%d. %s", i+1, item))
+		}
+	}
+	section("优点", f.Strengths)
+	issues := make([]string, 0, len(f.Issues))
+	for _, issue := range f.Issues {
+		if issue.Quote == "" {
+			issues = append(issues, issue.Problem)
+		} else {
+			issues = append(issues, fmt.Sprintf("\"%s\": %s", issue.Quote, issue.Problem))
+		}
+	}
+	section("问题", issues)
+	section("建议", f.Suggestions)
+	if f.Encouragement != "" {
+		builder.WriteString("\n" + f.Encouragement)
+	}
+	return builder.String()
+}
+
+// compact 去除空白的条目, 最多保留maxItems条
+func compact(items []string) []string {
+	kept := items[:0]
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			kept = append(kept, item)
+		}
+	}
+	return kept[:min(len(kept), maxItems)]
+}
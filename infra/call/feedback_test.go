@@ -0,0 +1,43 @@
+package call
+
+import (
+	"errors"
+	"github.com/cloudwego/eino/schema"
+	"testing"
+)
+
+func TestParseFeedback(t *testing.T) {
+	// 去除代码块标记与多余的逗号, 丢弃引用内容不在原文中的问题
+	content := "```json\n" + `{
+  "summary": "读得很流畅。",
+  "strengths": ["声音洪亮", " "],
+  "issues": [{"quote": "疑是", "problem": "\"是\"读成了\"似\""}, {"quote": "举头", "problem": "原文中没有"},],
+  "suggestions": ["放慢语速"],
+  "encouragement": "继续加油！",
+}` + "\n```"
+	f, err := ParseFeedback(content, "床前明月光，疑是地上霜。")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Strengths) != 1 || len(f.Issues) != 1 || f.Issues[0].Quote != "疑是" {
+		t.Fatalf("unexpected feedback %+v", f)
+	}
+	expected := "读得很流畅。\n优点:\n1. 声音洪亮\n问题:\n1. \"疑是\": \"是\"读成了\"似\"\n建议:\n1. 放慢语速\n继续加油！"
+	if s := f.String(); s != expected {
+		t.Fatalf("unexpected text %q", s)
+	}
+
+	for _, content = range []string{"读得很好", `{"summary": ""}`, `{"summary": "很好", "strengths": []}`, `{"summary": 1}`} {
+		if _, err = ParseFeedback(content, ""); !errors.Is(err, InvalidFeedback) {
+			t.Fatalf("expected invalid feedback for %s, got %v", content, err)
+		}
+	}
+}
+
+func TestQueryWithoutUsage(t *testing.T) {
+	// 回复中没有用量信息时不应panic
+	task := &CommentTask{id: 1, resp: &schema.Message{Content: "{}"}, feedback: &Feedback{Summary: "读得很流畅"}}
+	if f, err := task.Query(); err != nil || f.Summary != "读得很流畅" {
+		t.Fatalf("unexpected feedback %+v, err %v", f, err)
+	}
+}
@@ -0,0 +1,71 @@
+package call
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 根据asr分句的起止时间分析朗读的流利度
+// 分句之间的间隔视为停顿, 超过longPause的停顿视为明显的犹豫
+// 语速按第一句开始到最后一句结束的时长计算, 不包括录音首尾的空白
+
+var (
+	minPause  = 300  // 计为停顿的最短间隔(毫秒), 更短的间隔视为正常换气
+	longPause = 2000 // 计为犹豫的最短间隔(毫秒)
+)
+
+// Fluency 流利度指标, 时间单位为毫秒
+type Fluency struct {
+	Language      string  `json:"language"`       // 原文语言, 英文按词计数
+	Chars         int     `json:"chars"`          // 朗读字数(英文为词数), 不包括标点与空白
+	Duration      int     `json:"duration"`       // 录音总时长
+	Speaking      int     `json:"speaking"`       // 说话时长, 各分句时长之和
+	Speed         float64 `json:"speed"`          // 语速(字或词/分钟)
+	Pauses        int     `json:"pauses"`         // 停顿次数
+	PauseTime     int     `json:"pause_time"`     // 停顿总时长
+	Hesitations   int     `json:"hesitations"`    // 犹豫次数
+	LongestPause  int     `json:"longest_pause"`  // 最长停顿
+	SpeakingRatio float64 `json:"speaking_ratio"` // 说话时长占总时长的比例
+}
+
+// AnalyzeFluency 分析识别结果的流利度, 没有分句信息时返回nil
+func AnalyzeFluency(resp *ASRTaskResp, lang string) *Fluency {
+	utterances := resp.Result.Utterances
+	if len(utterances) == 0 {
+		return nil
+	}
+	f := &Fluency{Language: lang, Chars: len(Tokenize(resp.Result.Text, lang)), Duration: resp.AudioInfo.Duration}
+	for i, u := range utterances {
+		f.Speaking += max(u.EndTime-u.StartTime, 0)
+		if i == 0 {
+			continue
+		}
+		if gap := u.StartTime - utterances[i-1].EndTime; gap >= minPause {
+			f.Pauses++
+			f.PauseTime += gap
+			f.LongestPause = max(f.LongestPause, gap)
+			if gap >= longPause {
+				f.Hesitations++
+			}
+		}
+	}
+	last := utterances[len(utterances)-1].EndTime
+	f.Duration = max(f.Duration, last) // 服务未返回音频时长时使用最后一句的结束时间
+	if span := last - utterances[0].StartTime; span > 0 {
+		f.Speed = float64(f.Chars) / (float64(span) / 60000)
+	}
+	if f.Duration > 0 {
+		f.SpeakingRatio = float64(f.Speaking) / float64(f.Duration)
+	}
+	return f
+}
+
+// String 格式化为提示词中的信息
+func (f *Fluency) String() string {
+	var builder strings.Builder
+	builder.WriteString(fmt.Sprintf("语速: %.0f %s/分钟\n", f.Speed, Unit(f.Language)))
+	builder.WriteString(fmt.Sprintf("停顿: %d 次, 共 %.1f 秒, 最长 %.1f 秒\n", f.Pauses, float64(f.PauseTime)/1000, float64(f.LongestPause)/1000))
+	builder.WriteString(fmt.Sprintf("明显犹豫(超过%d秒的停顿): %d 次\n", longPause/1000, f.Hesitations))
+	builder.WriteString(fmt.Sprintf("说话时长占比: %.0f%%\n", f.SpeakingRatio*100))
+	return builder.String()
+}
@@ -0,0 +1,31 @@
+package call
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnalyzeFluency(t *testing.T) {
+	resp := &ASRTaskResp{
+		AudioInfo: AudioInfo{Duration: 10000},
+		Result: Result{Text: "床前明月光，疑是地上霜。举头望明月",
+			Utterances: []Utterance{
+				{Text: "床前明月光", StartTime: 1000, EndTime: 3000},
+				{Text: "疑是地上霜", StartTime: 3200, EndTime: 5000}, // 200毫秒, 不计为停顿
+				{Text: "举头望明月", StartTime: 7500, EndTime: 9000}, // 2.5秒, 计为犹豫
+			}},
+	}
+	f := AnalyzeFluency(resp, LangZH)
+	if f.Chars != 15 || f.Speaking != 5300 || f.Pauses != 1 || f.PauseTime != 2500 || f.Hesitations != 1 || f.LongestPause != 2500 {
+		t.Fatalf("unexpected fluency %+v", f)
+	}
+	if f.Speed != 112.5 || f.SpeakingRatio != 0.53 { // 15字/8秒
+		t.Fatalf("unexpected speed %f or ratio %f", f.Speed, f.SpeakingRatio)
+	}
+	if info := formatInfos("", "", Compare("", "", LangZH, false), f)["info"].(string); !strings.Contains(info, "语速: 112 字/分钟") {
+		t.Fatalf("unexpected info %s", info)
+	}
+	if AnalyzeFluency(&ASRTaskResp{}, LangZH) != nil {
+		t.Fatal("fluency without utterances should be nil")
+	}
+}
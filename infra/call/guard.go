@@ -0,0 +1,183 @@
+package call
+
+import (
+	"errors"
+	"fmt"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/config"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 评语写入数据库之前的检查
+// markdown标记与emoji直接去除, 客户端以纯文本展示
+// 长度超出范围, 文字不是期望的书写系统或包括禁用的词语时视为违规, 将原因反馈给大模型重新生成
+// 重新生成的次数用尽后使用兜底的评语
+
+const (
+	ScriptHan   = "han"   // 评语应以汉字为主
+	ScriptLatin = "latin" // 评语应以拉丁字母为主
+	ScriptAny   = "any"   // 不检查书写系统
+)
+
+// Guard 评语的检查规则, 为零的规则不生效
+type Guard struct {
+	MinLength int      // 展开后的最少字符数
+	MaxLength int      // 展开后的最多字符数
+	Script    string   // 期望的书写系统, 为空时按原文的语言
+	MinScript float64  // 期望的书写系统在汉字与字母中的最低占比
+	Banned    []string // 禁用的词语, 不区分大小写
+	Fallback  string   // 兜底的评语
+}
+
+var (
+	guard          *Guard
+	guardOnce      sync.Once
+	GuardViolation = errors.New("评语未通过检查")
+	scriptNames    = map[string]string{ScriptHan: "中文", ScriptLatin: "英文"}
+	langScripts    = map[string]string{LangZH: ScriptHan, LangEN: ScriptLatin} // 未配置书写系统时按原文的语言
+	markdowns      = []struct {
+		re   *regexp.Regexp
+		with string
+	}{
+		{regexp.MustCompile(`(?m)^[ \t]*#{1,6}[ \t]*`), ""},                  // 标题
+		{regexp.MustCompile(`(?m)^[ \t]*>[ \t]?`), ""},                       // 引用
+		{regexp.MustCompile(`(?m)^[ \t]*(?:[-*+]|\d+[.)])[ \t]+`), ""},       // 列表
+		{regexp.MustCompile(`!?\[([^\]\n]*)\]\([^)\n]*\)`), "$1"},            // 链接与图片
+		{regexp.MustCompile("\\*\\*|__|~~|`"), ""},                           // 加粗, 删除线与代码
+		{regexp.MustCompile(`\*([^*\n]+)\*`), "$1"},                          // 斜体
+		{regexp.MustCompile(`(?m)^[ \t]*(?:-{3,}|\*{3,}|_{3,})[ \t]*$`), ""}, // 分隔线
+	}
+)
+
+// GetGuard 根据配置创建检查规则
+func GetGuard() *Guard {
+	guardOnce.Do(func() {
+		conf := config.GetConfig().Comment.Guard
+		guard = &Guard{
+			MinLength: conf.MinLength,
+			MaxLength: conf.MaxLength,
+			Script:    conf.Script,
+			MinScript: conf.MinScript,
+			Banned:    conf.Banned,
+			Fallback:  conf.Fallback,
+		}
+	})
+	return guard
+}
+
+// ScriptOf 评语期望的书写系统, 依次为模板的配置, 检查规则的配置与原文的语言
+func (g *Guard) ScriptOf(lang string, tpl *Template) string {
+	if tpl != nil && tpl.Script != "" {
+		return tpl.Script
+	} else if g.Script != "" {
+		return g.Script
+	} else if script, ok := langScripts[lang]; ok {
+		return script
+	}
+	return ScriptAny
+}
+
+// Check 去除评语中的markdown标记与emoji后检查, script为期望的书写系统, 违规时返回GuardViolation
+func (g *Guard) Check(f *Feedback, script string) error {
+	f.Sanitize()
+	text := f.String()
+	if n := utf8.RuneCountInString(text); g.MinLength > 0 && n < g.MinLength {
+		return fmt.Errorf("%w: 评语过短, 只有%d字, 至少需要%d字", GuardViolation, n, g.MinLength)
+	} else if g.MaxLength > 0 && n > g.MaxLength {
+		return fmt.Errorf("%w: 评语过长, 共%d字, 最多%d字", GuardViolation, n, g.MaxLength)
+	}
+	if ratio, ok := g.script(f, script); !ok {
+		return fmt.Errorf("%w: 评语应使用%s, 占比只有%.0f%%", GuardViolation, scriptNames[script], ratio*100)
+	}
+	lower := strings.ToLower(text)
+	for _, phrase := range g.Banned {
+		if phrase != "" && strings.Contains(lower, strings.ToLower(phrase)) {
+			return fmt.Errorf("%w: 包括不应使用的词语\"%s\"", GuardViolation, phrase)
+		}
+	}
+	return nil
+}
+
+// script 检查期望的书写系统的占比, 引用的原文不计入
+func (g *Guard) script(f *Feedback, script string) (float64, bool) {
+	if script == "" || script == ScriptAny || g.MinScript <= 0 {
+		return 1, true
+	}
+	var han, latin int
+	count := func(s string) {
+		for _, r := range s {
+			if unicode.Is(unicode.Han, r) {
+				han++
+			} else if unicode.Is(unicode.Latin, r) {
+				latin++
+			}
+		}
+	}
+	count(f.Summary)
+	count(f.Encouragement)
+	for _, s := range append(append([]string{}, f.Strengths...), f.Suggestions...) {
+		count(s)
+	}
+	for _, issue := range f.Issues {
+		count(issue.Problem)
+	}
+	if han+latin == 0 {
+		return 0, false
+	}
+	ratio := float64(han) / float64(han+latin)
+	if script == ScriptLatin {
+		ratio = 1 - ratio
+	}
+	return ratio, ratio >= g.MinScript
+}
+
+// Safe 兜底的评语, 只包括总体评价
+func (g *Guard) Safe() *Feedback {
+	return &Feedback{Summary: g.Fallback, Fallback: true}
+}
+
+// Sanitize 去除各字段中的markdown标记与emoji, 去除后为空的条目与问题一并丢弃
+func (f *Feedback) Sanitize() {
+	f.Summary, f.Encouragement = sanitize(f.Summary), sanitize(f.Encouragement)
+	for i := range f.Strengths {
+		f.Strengths[i] = sanitize(f.Strengths[i])
+	}
+	for i := range f.Suggestions {
+		f.Suggestions[i] = sanitize(f.Suggestions[i])
+	}
+	issues := f.Issues[:0]
+	for _, issue := range f.Issues {
+		if issue.Problem = sanitize(issue.Problem); issue.Problem != "" {
+			issues = append(issues, issue)
+		}
+	}
+	f.Issues = issues
+	f.Strengths, f.Suggestions = compact(f.Strengths), compact(f.Suggestions)
+}
+
+func sanitize(s string) string {
+	for _, md := range markdowns {
+		s = md.re.ReplaceAllString(s, md.with)
+	}
+	s = strings.Map(func(r rune) rune {
+		if emoji(r) {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimSpace(s)
+}
+
+// emoji 常见的emoji, 包括组合emoji的连接符与变体选择符
+func emoji(r rune) bool {
+	switch {
+	case r >= 0x1F000 && r <= 0x1FAFF, r >= 0x2600 && r <= 0x27BF, r >= 0x2B00 && r <= 0x2BFF:
+		return true
+	case r == 0x200D, r == 0xFE0F, r == 0x20E3:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package call
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestGuardCheck(t *testing.T) {
+	g := &Guard{MinLength: 10, MaxLength: 120, Script: ScriptHan, MinScript: 0.6, Banned: []string{"笨"}}
+	// 去除markdown标记与emoji, 引用的英文原文不计入书写系统的占比
+	f := &Feedback{
+		Summary:       "## **读得很流畅**👍",
+		Issues:        []Issue{{Quote: "The quick brown fox jumps over the lazy dog", Problem: "漏读了 *brown*"}},
+		Suggestions:   []string{"- 注意 `over` 的发音", "🎉"},
+		Encouragement: "继续加油！💪",
+	}
+	if err := g.Check(f, ScriptHan); err != nil {
+		t.Fatal(err)
+	}
+	if f.Summary != "读得很流畅" || f.Issues[0].Problem != "漏读了 brown" || len(f.Suggestions) != 1 || f.Suggestions[0] != "注意 over 的发音" || f.Encouragement != "继续加油！" {
+		t.Fatalf("unexpected feedback %+v", f)
+	}
+
+	for _, f = range []*Feedback{
+		{Summary: "很好"},
+		{Summary: strings.Repeat("读得很流畅, ", 20)},
+		{Summary: "Great job, you read it very fluently!"},
+		{Summary: "这次读得有点笨拙, 下次努力"},
+	} {
+		if err := g.Check(f, ScriptHan); !errors.Is(err, GuardViolation) {
+			t.Fatalf("expected violation for %s, got %v", f.Summary, err)
+		}
+	}
+	if f = g.Safe(); !f.Fallback {
+		t.Fatal("expected fallback")
+	}
+
+	// 英文原文的评语以字母为主, 只有emoji的问题去除后丢弃
+	f = &Feedback{Summary: "Great job, you read it very fluently!", Issues: []Issue{{Quote: "fox", Problem: "👍"}}}
+	if err := g.Check(f, g.ScriptOf(LangEN, nil)); !errors.Is(err, GuardViolation) {
+		t.Fatalf("expected violation for configured han script, got %v", err)
+	}
+	g.Script = ""
+	if err := g.Check(f, g.ScriptOf(LangEN, nil)); err != nil || len(f.Issues) != 0 {
+		t.Fatalf("unexpected err %v, feedback %+v", err, f)
+	}
+	if script := g.ScriptOf(LangEN, &Template{Script: ScriptAny}); script != ScriptAny {
+		t.Fatalf("expected template script, got %s", script)
+	}
+}
@@ -0,0 +1,159 @@
+package call
+
+import (
+	"context"
+	"github.com/zeromicro/go-zero/core/logx"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/config"
+	"math"
+	"sync"
+	"time"
+)
+
+// 对上游服务的调用由全局的Limiter限制, 所有消费者共享
+// qps与tpm使用令牌桶, 取令牌时先预扣, 不足的部分按速率计算需要等待的时间
+// 并发数使用信号量, asr任务从提交到查询结束一直占用
+
+var (
+	asrLimiter     *Limiter
+	commentLimiter *Limiter
+	limiterOnce    sync.Once
+)
+
+type (
+	// Limiter 一个上游服务的限流器, 各项限制为零时表示不限制
+	Limiter struct {
+		name   string
+		qps    *bucket       // 每秒请求数
+		tpm    *bucket       // 每分钟token数
+		slots  chan struct{} // 并发数
+		tokens int           // tpm桶的容量, 单次预扣不超过该值
+	}
+	// bucket 令牌桶, tokens可以为负, 表示已被预扣
+	bucket struct {
+		mu     sync.Mutex
+		rate   float64 // 每秒补充的令牌数
+		burst  float64 // 桶的容量
+		tokens float64
+		last   time.Time
+	}
+)
+
+// NewLimiter 创建限流器, qps为每秒请求数, concurrency为最大并发数, tpm为每分钟token数
+func NewLimiter(name string, qps float64, concurrency, tpm int) *Limiter {
+	l := &Limiter{name: name, tokens: tpm}
+	if qps > 0 {
+		l.qps = newBucket(qps, math.Max(qps, 1))
+	}
+	if tpm > 0 {
+		l.tpm = newBucket(float64(tpm)/60, float64(tpm))
+	}
+	if concurrency > 0 {
+		l.slots = make(chan struct{}, concurrency)
+	}
+	return l
+}
+
+// limiters 根据配置创建asr与comment的限流器
+func limiters() {
+	limiterOnce.Do(func() {
+		conf := config.GetConfig().Limits
+		asrLimiter = NewLimiter("asr", conf.ASR.QPS, conf.ASR.Concurrency, 0)
+		commentLimiter = NewLimiter("comment", conf.Comment.QPS, conf.Comment.Concurrency, conf.Comment.TPM)
+	})
+}
+
+// ASRLimiter asr服务的限流器
+func ASRLimiter() *Limiter {
+	limiters()
+	return asrLimiter
+}
+
+// CommentLimiter 大模型服务的限流器
+func CommentLimiter() *Limiter {
+	limiters()
+	return commentLimiter
+}
+
+// Acquire 占用一个并发槽位, 返回释放函数, 重复调用释放函数是安全的
+func (l *Limiter) Acquire(ctx context.Context) (release func(), err error) {
+	if l.slots == nil {
+		return func() {}, nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+	default: // 已达到并发上限, 等待
+		logx.Infof("[limiter] %s reach concurrency limit %d, wait", l.name, cap(l.slots))
+		select {
+		case l.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	var once sync.Once
+	return func() { once.Do(func() { <-l.slots }) }, nil
+}
+
+// Wait 等待一次请求的qps配额
+func (l *Limiter) Wait(ctx context.Context) error {
+	return l.wait(ctx, l.qps, 1)
+}
+
+// WaitTokens 等待n个token的tpm配额, n为预估值, 实际用量通过Adjust修正
+func (l *Limiter) WaitTokens(ctx context.Context, n int) error {
+	return l.wait(ctx, l.tpm, float64(min(n, l.tokens)))
+}
+
+// Adjust 用实际用量修正预扣的token数
+func (l *Limiter) Adjust(estimated, used int) {
+	if l.tpm == nil {
+		return
+	}
+	l.tpm.mu.Lock()
+	defer l.tpm.mu.Unlock()
+	l.tpm.tokens += float64(min(estimated, l.tokens) - used)
+}
+
+func (l *Limiter) wait(ctx context.Context, b *bucket, n float64) error {
+	if b == nil {
+		return nil
+	}
+	d := b.reserve(n)
+	if d <= 0 {
+		return nil
+	}
+	logx.Infof("[limiter] %s reach rate limit, wait %s", l.name, d)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.cancel(n)
+		return ctx.Err()
+	}
+}
+
+func newBucket(rate, burst float64) *bucket {
+	return &bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve 预扣n个令牌, 返回需要等待的时间
+func (b *bucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel 归还预扣的令牌
+func (b *bucket) cancel(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+n)
+}
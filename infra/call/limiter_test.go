@@ -0,0 +1,57 @@
+package call
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiterConcurrency(t *testing.T) {
+	l := NewLimiter("test", 0, 1, 0)
+	release, err := l.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = l.Acquire(ctx); err == nil { // 槽位已被占用, 应当等待至超时
+		t.Fatal("acquire should wait for release")
+	}
+	release()
+	release() // 重复释放不影响其他槽位
+	if release, err = l.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestLimiterQPS(t *testing.T) {
+	l := NewLimiter("test", 20, 0, 0)
+	start := time.Now()
+	for range 40 {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 初始的20个令牌立即可用, 其余20个需要约1秒
+	if d := time.Since(start); d < 900*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("unexpected elapsed %s", d)
+	}
+}
+
+func TestLimiterTPM(t *testing.T) {
+	l := NewLimiter("test", 0, 0, 600)
+	if err := l.WaitTokens(context.Background(), 600); err != nil {
+		t.Fatal(err)
+	}
+	// 实际只用了300个, 归还的300个足够下一次使用
+	l.Adjust(600, 300)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.WaitTokens(ctx, 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.WaitTokens(ctx, 300); err == nil { // 额度用尽, 需要等待30秒
+		t.Fatal("wait tokens should exceed deadline")
+	}
+}
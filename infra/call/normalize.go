@@ -0,0 +1,174 @@
+package call
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// 原文与朗读文本按语言切分为比较单位后再计算编辑距离
+// 中文去除标点与空白后以单字为单位
+// 英文统一小写, 展开缩写, 数字转为单词, 去除标点后以单词为单位, 避免大小写, 标点与写法差异被计为朗读错误
+
+const (
+	LangZH = "zh" // 中文
+	LangEN = "en" // 英文
+)
+
+var (
+	// contractions 常见缩写的展开, 's可能是is/has/所有格, 不展开
+	contractions = []struct {
+		re   *regexp.Regexp
+		with string
+	}{
+		{regexp.MustCompile(`\bwon't\b`), "will not"},
+		{regexp.MustCompile(`\bcan't\b`), "can not"},
+		{regexp.MustCompile(`\bshan't\b`), "shall not"},
+		{regexp.MustCompile(`\bain't\b`), "is not"},
+		{regexp.MustCompile(`n't\b`), " not"},
+		{regexp.MustCompile(`\bi'm\b`), "i am"},
+		{regexp.MustCompile(`'re\b`), " are"},
+		{regexp.MustCompile(`'ve\b`), " have"},
+		{regexp.MustCompile(`'ll\b`), " will"},
+		{regexp.MustCompile(`'d\b`), " would"},
+		{regexp.MustCompile(`\blet's\b`), "let us"},
+	}
+	cannot  = regexp.MustCompile(`\bcannot\b`)
+	numbers = regexp.MustCompile(`\d+(,\d{3})*`)
+	ones    = []string{"zero", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine", "ten",
+		"eleven", "twelve", "thirteen", "fourteen", "fifteen", "sixteen", "seventeen", "eighteen", "nineteen"}
+	tens = []string{"", "", "twenty", "thirty", "forty", "fifty", "sixty", "seventy", "eighty", "ninety"}
+)
+
+// Language 确定原文的语言, 题目指定了语言时直接使用, 否则根据原文检测
+func Language(declared, text string) string {
+	switch strings.ToLower(declared) {
+	case LangZH, LangEN:
+		return strings.ToLower(declared)
+	}
+	return DetectLanguage(text)
+}
+
+// DetectLanguage 根据汉字与拉丁字母的数量检测语言, 汉字不少于字母的五分之一时视为中文
+func DetectLanguage(text string) string {
+	var han, latin int
+	for _, r := range text {
+		if unicode.Is(unicode.Han, r) {
+			han++
+		} else if unicode.Is(unicode.Latin, r) {
+			latin++
+		}
+	}
+	// 英文单词平均约5个字母, 按单位数量比较
+	if latin > 0 && han*5 < latin {
+		return LangEN
+	}
+	return LangZH
+}
+
+// Token 比较单位, Offset为在原始文本中的字符(rune)偏移
+type Token struct {
+	Text   string
+	Offset int
+}
+
+// Tokenize 将文本按语言切分为比较单位
+func Tokenize(text, lang string) []string {
+	tokens := tokenize(text, lang)
+	texts := make([]string, len(tokens))
+	for i, token := range tokens {
+		texts[i] = token.Text
+	}
+	return texts
+}
+
+// tokenize 切分并记录每个单位在原始文本中的偏移
+// 英文按空白分出原始单词后逐个归一化, 缩写与数字展开出的多个词共用原始单词的偏移
+func tokenize(text, lang string) []Token {
+	var tokens []Token
+	if lang != LangEN {
+		for i, r := range []rune(text) {
+			if !punctuations[r] && !whitespaces[r] {
+				tokens = append(tokens, Token{Text: string(r), Offset: i})
+			}
+		}
+		return tokens
+	}
+	start := -1
+	runes := append([]rune(text), ' ')
+	for i, r := range runes {
+		if !unicode.IsSpace(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			for _, word := range strings.Fields(normalizeEnglish(string(runes[start:i]))) {
+				tokens = append(tokens, Token{Text: word, Offset: start})
+			}
+			start = -1
+		}
+	}
+	return tokens
+}
+
+// Unit 比较单位的名称
+func Unit(lang string) string {
+	if lang == LangEN {
+		return "词"
+	}
+	return "字"
+}
+
+// normalizeEnglish 小写, 展开缩写, 数字转为单词, 去除标点
+func normalizeEnglish(text string) string {
+	text = strings.ToLower(strings.NewReplacer("’", "'", "‘", "'").Replace(text))
+	for _, c := range contractions {
+		text = c.re.ReplaceAllString(text, c.with)
+	}
+	text = cannot.ReplaceAllString(text, "can not")
+	text = numbers.ReplaceAllStringFunc(text, func(s string) string {
+		n, err := strconv.Atoi(strings.ReplaceAll(s, ",", ""))
+		if err != nil || n >= 1000000000 {
+			return s
+		}
+		return " " + spell(n) + " "
+	})
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\'':
+			return -1 // 所有格等剩余的撇号直接删除
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r) || unicode.Is(unicode.Han, r):
+			return ' ' // 连字符等标点视为单词的分隔, 混入的全角标点与汉字同样处理
+		}
+		return r
+	}, text)
+}
+
+// spell 将非负整数转为英文单词
+func spell(n int) string {
+	switch {
+	case n < 20:
+		return ones[n]
+	case n < 100:
+		if n%10 == 0 {
+			return tens[n/10]
+		}
+		return tens[n/10] + " " + ones[n%10]
+	}
+	for _, unit := range []struct {
+		value int
+		name  string
+	}{{1000000, "million"}, {1000, "thousand"}, {100, "hundred"}} {
+		if n >= unit.value {
+			s := spell(n/unit.value) + " " + unit.name
+			if n%unit.value != 0 {
+				s += " " + spell(n%unit.value)
+			}
+			return s
+		}
+	}
+	return ""
+}
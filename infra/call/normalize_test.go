@@ -0,0 +1,44 @@
+package call
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	if lang := DetectLanguage("The quick brown fox, 狐狸."); lang != LangEN {
+		t.Fatalf("unexpected language %s", lang)
+	}
+	if lang := DetectLanguage("床前明月光, moon"); lang != LangZH {
+		t.Fatalf("unexpected language %s", lang)
+	}
+	if lang := Language("EN", "床前明月光"); lang != LangEN {
+		t.Fatalf("declared language should be used, got %s", lang)
+	}
+
+	cases := []struct {
+		text   string
+		tokens string
+	}{
+		{"I can't go, it's 21 miles!", "i can not go its twenty one miles"},
+		{"We’re 3 well-known friends.", "we are three well known friends"},
+		{"Tom's 1,250 books", "toms one thousand two hundred fifty books"},
+	}
+	for _, c := range cases {
+		if tokens := Tokenize(c.text, LangEN); strings.Join(tokens, " ") != c.tokens {
+			t.Fatalf("tokenize %q: unexpected tokens %q", c.text, tokens)
+		}
+	}
+	if tokens := Tokenize("床前，明月光。", LangZH); !slices.Equal(tokens, []string{"床", "前", "明", "月", "光"}) {
+		t.Fatalf("unexpected tokens %q", tokens)
+	}
+
+	// 大小写, 标点与数字写法不同不计为错误, 漏读一个词计为一处
+	if c := Compare("I don't have 2 cats.", "i do not have two cats", LangEN, false); c.Distance != 0 || c.OriginLen != 6 {
+		t.Fatalf("unexpected comparison %+v", c)
+	}
+	if c := Compare("The cat sat on the mat.", "the cat sat on mat", LangEN, false); c.Distance != 1 {
+		t.Fatalf("unexpected comparison %+v", c)
+	}
+}
@@ -0,0 +1,211 @@
+package call
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/avast/retry-go"
+	"github.com/zeromicro/go-zero/core/logx"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+// 兼容OpenAI /v1/audio/transcriptions的asr服务, 同步返回识别结果
+// 该接口需要上传音频文件, 因此先下载音频再以multipart表单提交
+// 只重试网络错误, 限流(429)与服务端错误(5xx), 其余状态码重试无法恢复
+
+var (
+	OpenAIProvider = "openai" // asr服务提供方
+	openAIModel    = "whisper-1"
+	openAIFormats  = map[string]bool{"flac": true, "m4a": true, "mp3": true, "ogg": true, "wav": true, "webm": true}
+)
+
+type (
+	// OpenAI 兼容OpenAI接口的asr服务
+	OpenAI struct {
+		URL     string // 完整的transcriptions接口地址
+		ApiKey  string
+		Model   string
+		MaxSize int64 // 下载音频的最大字节数, 为零时不限制, 超过时返回InvalidAudio
+	}
+	// statusError 非2xx的响应
+	statusError struct {
+		Code int
+		Body []byte
+	}
+	// transcription verbose_json格式的识别结果
+	transcription struct {
+		Text     string    `json:"text"`
+		Duration float64   `json:"duration"` // 音频时长(秒)
+		Segments []segment `json:"segments"`
+		Words    []word    `json:"words"` // 请求词级时间戳时返回
+	}
+	segment struct {
+		Text  string  `json:"text"`
+		Start float64 `json:"start"` // 起始时间(秒)
+		End   float64 `json:"end"`   // 结束时间(秒)
+	}
+	word struct {
+		Word  string  `json:"word"`
+		Start float64 `json:"start"` // 起始时间(秒)
+		End   float64 `json:"end"`   // 结束时间(秒)
+	}
+)
+
+// NewOpenAI 创建兼容OpenAI接口的asr服务, baseURL为服务地址, 不包括/v1
+func NewOpenAI(baseURL, apiKey, model string) *OpenAI {
+	if model == "" {
+		model = openAIModel
+	}
+	return &OpenAI{URL: strings.TrimRight(baseURL, "/") + "/v1/audio/transcriptions", ApiKey: apiKey, Model: model}
+}
+
+// Recognize 下载音频并提交识别, 占用asr限流器的一个并发槽位
+func (o *OpenAI) Recognize(ctx context.Context, t *FileAsrTask) (*ASRTaskResp, error) {
+	release, err := ASRLimiter().Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var audio, raw []byte
+	if err = retry.Do(func() (err error) {
+		audio, err = o.download(ctx, t.Url)
+		return err
+	}, append(opts, retry.Context(ctx), retry.LastErrorOnly(true), retry.RetryIf(retryable))...); err != nil {
+		logx.Errorf("[asr file task] download %s err: %s", t.Url, err)
+		return nil, err
+	}
+	if err = retry.Do(func() (err error) {
+		if err = ASRLimiter().Wait(ctx); err != nil {
+			return err
+		}
+		if raw, err = o.transcribe(ctx, t, audio); err != nil {
+			logx.Errorf("[asr file task] transcribe err: %s", err)
+		}
+		return err
+	}, append(opts, retry.Context(ctx), retry.LastErrorOnly(true), retry.RetryIf(retryable))...); err != nil {
+		return nil, err
+	}
+
+	resp, err := parseTranscription(raw)
+	if err != nil {
+		return nil, err
+	}
+	resp.Provider, resp.ModelVersion, resp.Raw = OpenAIProvider, o.Model, raw
+	resp.Biased = t.Origin != ""
+	return resp, nil
+}
+
+// Supports 接口要求上传带容器的音频文件, 不支持裸pcm
+func (o *OpenAI) Supports(f *AudioFormat) bool {
+	return openAIFormats[f.Format]
+}
+
+// download 下载音频, 超过MaxSize时返回InvalidAudio
+func (o *OpenAI) download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return o.do(req, o.MaxSize)
+}
+
+// transcribe 提交音频, 返回原始响应
+func (o *OpenAI) transcribe(ctx context.Context, t *FileAsrTask, audio []byte) ([]byte, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	file, err := form.CreateFormFile("file", t.Uid+"."+t.Format)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Write(audio); err != nil {
+		return nil, err
+	}
+	_ = form.WriteField("model", o.Model)
+	_ = form.WriteField("response_format", "verbose_json")
+	_ = form.WriteField("timestamp_granularities[]", "segment")
+	_ = form.WriteField("timestamp_granularities[]", "word")
+	if t.Origin != "" { // 使用原文提示识别
+		_ = form.WriteField("prompt", buildPrompt(t.Origin))
+	}
+	if err = form.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.URL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+o.ApiKey)
+	return o.do(req, 0)
+}
+
+// do 发送请求并读取响应体, limit为响应体的最大字节数, 为零时不限制
+// 非2xx的响应返回statusError
+func (o *OpenAI) do(req *http.Request, limit int64) ([]byte, error) {
+	resp, err := GetHttpClient().Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	var reader io.Reader = resp.Body
+	if limit > 0 {
+		reader = io.LimitReader(resp.Body, limit+1)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &statusError{Code: resp.StatusCode, Body: body}
+	}
+	if limit > 0 && int64(len(body)) > limit {
+		return nil, fmt.Errorf("%w: size exceeds %d bytes", InvalidAudio, limit)
+	}
+	return body, nil
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status code: %d, response body: %s", e.Code, e.Body)
+}
+
+// retryable 网络错误, 429与5xx可以重试, 其余状态码与过大的音频重试无法恢复
+func retryable(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.Code == http.StatusTooManyRequests || se.Code >= http.StatusInternalServerError
+	}
+	return !errors.Is(err, InvalidAudio)
+}
+
+// parseTranscription 将verbose_json格式的结果转换为ASRTaskResp
+// 响应与期望的格式不符时返回DecodeFailed, 词级时间戳与分句分别返回, 按起始时间归入所在的分句, 该接口不返回置信度
+func parseTranscription(raw []byte) (*ASRTaskResp, error) {
+	tr, err := Decode[transcription](raw)
+	if err != nil {
+		return nil, err
+	}
+	resp := &ASRTaskResp{Result: Result{Text: tr.Text}, AudioInfo: AudioInfo{Duration: int(tr.Duration * 1000)}}
+	var i int
+	for _, seg := range tr.Segments {
+		utterance := Utterance{
+			Text:      strings.TrimSpace(seg.Text),
+			StartTime: int(seg.Start * 1000),
+			EndTime:   int(seg.End * 1000),
+		}
+		for ; i < len(tr.Words) && tr.Words[i].Start < seg.End; i++ {
+			utterance.Words = append(utterance.Words, Word{
+				Text:      strings.TrimSpace(tr.Words[i].Word),
+				StartTime: int(tr.Words[i].Start * 1000),
+				EndTime:   int(tr.Words[i].End * 1000),
+			})
+		}
+		resp.Result.Utterances = append(resp.Result.Utterances, utterance)
+	}
+	return resp, nil
+}
@@ -0,0 +1,66 @@
+package call
+
+import (
+	_ "embed"
+	"strings"
+	"sync"
+)
+
+// 汉字到拼音的对照表, 覆盖GB2312中的常用字, 多音字列出常见的读音
+// 每行为 拼音+声调(1-5, 5为轻声, ü写作v) 与该读音的全部汉字, 以空格分隔
+// 按拼音比较时, 读音相同的替换视为asr的同音字差异, 只有声调不同的视为轻微错误
+
+//go:embed pinyin.txt
+var pinyinData string
+
+var (
+	pinyinTable map[rune][]string
+	pinyinOnce  sync.Once
+)
+
+// Pinyin 汉字的全部读音, 不在表中时返回nil
+func Pinyin(r rune) []string {
+	pinyinOnce.Do(func() {
+		pinyinTable = make(map[rune][]string)
+		for _, line := range strings.Split(pinyinData, "\n") {
+			reading, chars, ok := strings.Cut(line, " ")
+			if !ok {
+				continue
+			}
+			for _, c := range chars {
+				pinyinTable[c] = append(pinyinTable[c], reading)
+			}
+		}
+	})
+	return pinyinTable[r]
+}
+
+// Homophone 按拼音判断两个字的关系: 字相同或读音相同为OpMatch或OpHomophone, 只有声调不同为OpTone, 否则为OpSubstitute
+func Homophone(a, b string) string {
+	if a == b {
+		return OpMatch
+	}
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) != 1 || len(rb) != 1 {
+		return OpSubstitute
+	}
+	op := OpSubstitute
+	for _, pa := range Pinyin(ra[0]) {
+		for _, pb := range Pinyin(rb[0]) {
+			if pa == pb {
+				return OpHomophone
+			} else if pa[:len(pa)-1] == pb[:len(pb)-1] {
+				op = OpTone
+			}
+		}
+	}
+	return op
+}
+
+// Exact 只有字相同才视为正确
+func Exact(a, b string) string {
+	if a == b {
+		return OpMatch
+	}
+	return OpSubstitute
+}
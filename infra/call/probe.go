@@ -0,0 +1,275 @@
+package call
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/avast/retry-go"
+	"github.com/zeromicro/go-zero/core/logx"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// 提交asr之前探测录音的格式, 通过Range请求读取文件头部
+// 优先根据文件头的魔数与头部信息判断容器, 编码, 采样率与声道数, 无法识别时参考MIME类型
+// 无法识别或asr服务不支持的格式返回UnsupportedAudio, 文件不存在或为空返回InvalidAudio, 重试均无法恢复
+
+var (
+	probeSize        = 4096 // 每次读取的头部字节数
+	UnsupportedAudio = errors.New("[audio probe] unsupported audio format")
+	defaultRaw       = AudioFormat{Format: "raw", Codec: "raw", Rate: 16000, Bits: 16, Channel: 1} // 裸pcm无法从文件中得知参数
+	// mimeFormats MIME类型对应的容器格式
+	mimeFormats = map[string]string{
+		"audio/wav": "wav", "audio/x-wav": "wav", "audio/wave": "wav", "audio/vnd.wave": "wav",
+		"audio/mpeg": "mp3", "audio/mp3": "mp3",
+		"audio/ogg": "ogg", "audio/opus": "ogg",
+		"audio/mp4": "m4a", "audio/m4a": "m4a", "audio/x-m4a": "m4a", "audio/aac": "m4a",
+		"audio/flac": "flac", "audio/x-flac": "flac",
+		"audio/webm": "webm",
+		"audio/pcm":  "raw", "audio/l16": "raw",
+	}
+	mp3Rates = map[byte][3]int{ // mpeg版本对应的采样率表
+		3: {44100, 48000, 32000}, // MPEG1
+		2: {22050, 24000, 16000}, // MPEG2
+		0: {11025, 12000, 8000},  // MPEG2.5
+	}
+	mp3Bitrates = map[bool][15]int{ // Layer III的比特率表(kbps), key为是否为MPEG1
+		true:  {0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		false: {0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	}
+)
+
+// AudioFormat 录音的格式, 未知的参数为零值
+type AudioFormat struct {
+	Format  string `json:"format"`  // 容器格式: wav/mp3/ogg/m4a/flac/webm/raw
+	Codec   string `json:"codec"`   // 编码格式: raw/opus/vorbis/aac等
+	Rate    int    `json:"rate"`    // 采样率
+	Bits    int    `json:"bits"`    // 采样点位数
+	Channel int    `json:"channel"` // 声道数
+	Bitrate int    `json:"bitrate"` // 比特率(bps), 目前只解析mp3
+	frames  int    // mp3的帧数, 来自Xing/Info/VBRI头, 未知时为0
+	cbr     bool   // mp3是否确定为固定比特率(Info头), 否则首帧的比特率不能代表整个文件
+}
+
+// ProbeAudio 探测录音的格式, contentType为答案中记录的MIME类型, 可以为空
+func ProbeAudio(ctx context.Context, url, contentType string) (*AudioFormat, error) {
+	f, _, _, err := probe(ctx, url, contentType)
+	return f, err
+}
+
+// probe 探测录音的格式, 同时返回读取到的文件头部与响应头
+// 文件不存在或为空时返回InvalidAudio
+func probe(ctx context.Context, url, contentType string) (f *AudioFormat, head []byte, header http.Header, err error) {
+	if err = retry.Do(func() (err error) {
+		head, header, err = readRange(ctx, url, 0, probeSize)
+		return err
+	}, append(opts, retry.Context(ctx), retry.LastErrorOnly(true), retry.RetryIf(func(err error) bool {
+		return !errors.Is(err, InvalidAudio) // 文件不存在时无需重试
+	}))...); err != nil {
+		logx.Errorf("[audio probe] read %s err: %s", url, err)
+		return nil, nil, nil, err
+	}
+	if len(head) == 0 {
+		return nil, nil, nil, fmt.Errorf("%w: empty file", InvalidAudio)
+	}
+
+	f = sniff(head)
+	if f != nil && f.Format == "mp3" && f.Rate == 0 { // ID3标签较大, 帧头不在已读取的范围内
+		if end := id3End(head); end > len(head) {
+			if frame, _, err := readRange(ctx, url, end, probeSize); err == nil {
+				if v := sniffMP3(frame); v != nil {
+					f = v
+				}
+			}
+		}
+	}
+	if f == nil { // 文件头无法识别, 参考MIME类型
+		if contentType == "" {
+			contentType = header.Get("Content-Type")
+		}
+		f = fromMIME(contentType)
+	}
+	if f == nil {
+		return nil, nil, nil, fmt.Errorf("%w: unknown content type %q", UnsupportedAudio, contentType)
+	}
+	return f, head, header, nil
+}
+
+// readRange 读取[offset, offset+n)范围内的字节, 服务不支持Range时只读取前n个字节
+func readRange(ctx context.Context, url string, offset, n int) ([]byte, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+n-1))
+	resp, err := GetHttpClient().Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch {
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable: // 文件比offset短
+		return nil, resp.Header, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusGone:
+		return nil, resp.Header, fmt.Errorf("%w: unreachable, status code %d", InvalidAudio, resp.StatusCode)
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, resp.Header, fmt.Errorf("unexpected status code: %d, response body: %s", resp.StatusCode, body)
+	case resp.StatusCode == http.StatusOK && offset > 0: // 不支持Range, 跳过offset之前的内容
+		if _, err = io.CopyN(io.Discard, resp.Body, int64(offset)); err != nil {
+			return nil, resp.Header, nil
+		}
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(n)))
+	return body, resp.Header, err
+}
+
+// sniff 根据文件头识别格式, 无法识别时返回nil
+func sniff(head []byte) *AudioFormat {
+	switch {
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WAVE":
+		return sniffWAV(head)
+	case bytes.HasPrefix(head, []byte("ID3")):
+		if f := sniffMP3(head[min(id3End(head), len(head)):]); f != nil {
+			return f
+		}
+		return &AudioFormat{Format: "mp3"}
+	case bytes.HasPrefix(head, []byte("OggS")):
+		return sniffOgg(head)
+	case bytes.HasPrefix(head, []byte("fLaC")):
+		return sniffFLAC(head)
+	case len(head) >= 8 && string(head[4:8]) == "ftyp":
+		return &AudioFormat{Format: "m4a", Codec: "aac"}
+	case bytes.HasPrefix(head, []byte{0x1A, 0x45, 0xDF, 0xA3}): // EBML
+		return &AudioFormat{Format: "webm"}
+	case len(head) > 0 && head[0] == 0xFF: // 没有ID3标签的mp3直接以帧头开始
+		return sniffMP3(head)
+	}
+	return nil
+}
+
+// sniffWAV 解析fmt块
+func sniffWAV(head []byte) *AudioFormat {
+	f := &AudioFormat{Format: "wav"}
+	for i := 12; i+8 <= len(head); {
+		id, size := string(head[i:i+4]), int(binary.LittleEndian.Uint32(head[i+4:i+8]))
+		if id == "fmt " && i+24 <= len(head) {
+			switch tag := binary.LittleEndian.Uint16(head[i+8:]); tag {
+			case 1, 0xFFFE: // PCM, WAVE_FORMAT_EXTENSIBLE
+				f.Codec = "raw"
+			case 3:
+				f.Codec = "float"
+			default:
+				f.Codec = fmt.Sprintf("0x%04x", tag)
+			}
+			f.Channel = int(binary.LittleEndian.Uint16(head[i+10:]))
+			f.Rate = int(binary.LittleEndian.Uint32(head[i+12:]))
+			f.Bits = int(binary.LittleEndian.Uint16(head[i+22:]))
+			return f
+		}
+		i += 8 + size + size%2 // 块按偶数字节对齐
+	}
+	return f
+}
+
+// id3End ID3标签结束的位置
+func id3End(head []byte) int {
+	if len(head) < 10 || !bytes.HasPrefix(head, []byte("ID3")) {
+		return 0
+	}
+	size := int(head[6]&0x7F)<<21 | int(head[7]&0x7F)<<14 | int(head[8]&0x7F)<<7 | int(head[9]&0x7F)
+	if head[5]&0x10 != 0 { // 带有footer
+		size += 10
+	}
+	return 10 + size
+}
+
+// sniffMP3 查找第一个有效的Layer III帧头
+func sniffMP3(data []byte) *AudioFormat {
+	for i := 0; i+4 <= len(data); i++ {
+		if data[i] != 0xFF || data[i+1]&0xE0 != 0xE0 {
+			continue
+		}
+		version, layer, idx, bitrate := (data[i+1]>>3)&3, (data[i+1]>>1)&3, (data[i+2]>>2)&3, data[i+2]>>4
+		rates, ok := mp3Rates[version]
+		if !ok || layer != 1 || idx == 3 || bitrate == 15 {
+			continue
+		}
+		f := &AudioFormat{Format: "mp3", Rate: rates[idx], Channel: 2, Bitrate: mp3Bitrates[version == 3][bitrate] * 1000}
+		if data[i+3]>>6 == 3 { // 单声道
+			f.Channel = 1
+		}
+		f.frames, f.cbr = mp3Header(data[i:], version == 3, f.Channel)
+		return f
+	}
+	return nil
+}
+
+// mp3Header 解析首帧中的Xing/Info头(位于side info之后)或VBRI头(位于帧头之后32字节), 返回帧数与是否为固定比特率
+// 编码器为固定比特率写入Info头, 为可变比特率写入Xing或VBRI头
+func mp3Header(frame []byte, mpeg1 bool, channel int) (frames int, cbr bool) {
+	side := 17 // side info的长度
+	switch {
+	case mpeg1 && channel == 1:
+	case mpeg1:
+		side = 32
+	case channel == 1:
+		side = 9
+	}
+	if i := 4 + side; i+8 <= len(frame) {
+		if tag := string(frame[i : i+4]); tag == "Xing" || tag == "Info" {
+			if binary.BigEndian.Uint32(frame[i+4:])&1 != 0 && i+12 <= len(frame) { // 帧数字段存在
+				frames = int(binary.BigEndian.Uint32(frame[i+8:]))
+			}
+			return frames, tag == "Info"
+		}
+	}
+	if i := 4 + 32; i+18 <= len(frame) && string(frame[i:i+4]) == "VBRI" {
+		return int(binary.BigEndian.Uint32(frame[i+14:])), false
+	}
+	return 0, false
+}
+
+// sniffOgg 根据第一个包的标识判断编码
+func sniffOgg(head []byte) *AudioFormat {
+	f := &AudioFormat{Format: "ogg"}
+	if i := bytes.Index(head, []byte("OpusHead")); i >= 0 && i+16 <= len(head) {
+		f.Codec, f.Channel = "opus", int(head[i+9])
+		f.Rate = int(binary.LittleEndian.Uint32(head[i+12:])) // 编码前的采样率
+	} else if i = bytes.Index(head, []byte("\x01vorbis")); i >= 0 && i+16 <= len(head) {
+		f.Codec, f.Channel = "vorbis", int(head[i+11])
+		f.Rate = int(binary.LittleEndian.Uint32(head[i+12:]))
+	}
+	return f
+}
+
+// sniffFLAC 解析STREAMINFO块
+func sniffFLAC(head []byte) *AudioFormat {
+	f := &AudioFormat{Format: "flac", Codec: "flac"}
+	if len(head) >= 26 {
+		f.Rate = int(head[18])<<12 | int(head[19])<<4 | int(head[20])>>4
+		f.Channel = int(head[20]>>1&7) + 1
+		f.Bits = int(head[20]&1)<<4 | int(head[21]>>4) + 1
+	}
+	return f
+}
+
+// fromMIME 根据MIME类型判断容器格式, 无法识别时返回nil
+func fromMIME(contentType string) *AudioFormat {
+	typ, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	format, ok := mimeFormats[strings.ToLower(typ)]
+	if !ok {
+		return nil
+	} else if format == "raw" {
+		f := defaultRaw
+		return &f
+	}
+	return &AudioFormat{Format: format}
+}
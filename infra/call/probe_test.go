@@ -0,0 +1,79 @@
+package call
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// wavHeader 构造一个pcm编码的wav文件头
+func wavHeader(rate, bits, channel int) []byte {
+	var b bytes.Buffer
+	b.WriteString("RIFF")
+	_ = binary.Write(&b, binary.LittleEndian, uint32(36))
+	b.WriteString("WAVEfmt ")
+	for _, v := range []any{uint32(16), uint16(1), uint16(channel), uint32(rate),
+		uint32(rate * channel * bits / 8), uint16(channel * bits / 8), uint16(bits)} {
+		_ = binary.Write(&b, binary.LittleEndian, v)
+	}
+	b.WriteString("data")
+	_ = binary.Write(&b, binary.LittleEndian, uint32(0))
+	return b.Bytes()
+}
+
+func TestProbeAudio(t *testing.T) {
+	// ID3标签超过一次读取的范围, 帧头需要再读取一次
+	id3 := append([]byte{'I', 'D', '3', 4, 0, 0, 0, 0, 0x40, 0}, make([]byte, 8192)...)
+	files := map[string][]byte{
+		"/1.wav":  wavHeader(16000, 16, 1),
+		"/1.mp3":  append(id3, 0xFF, 0xF3, 0x84, 0xC4), // MPEG2 Layer III, 24000Hz, 单声道
+		"/1.m4a":  []byte("\x00\x00\x00\x20ftypM4A "),
+		"/1.pcm":  {1, 2, 3, 4},
+		"/empty":  {},
+		"/1.opus": []byte("OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00OpusHead\x01\x01\x38\x01\x80\x3e\x00\x00"),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(file))
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		path, contentType string
+		want              AudioFormat
+	}{
+		{"/1.wav", "", AudioFormat{Format: "wav", Codec: "raw", Rate: 16000, Bits: 16, Channel: 1}},
+		{"/1.mp3", "", AudioFormat{Format: "mp3", Rate: 24000, Channel: 1, Bitrate: 64000}},
+		{"/1.m4a", "audio/wav", AudioFormat{Format: "m4a", Codec: "aac"}}, // 以文件头为准
+		{"/1.pcm", "audio/pcm;rate=16000", defaultRaw},
+		{"/1.opus", "", AudioFormat{Format: "ogg", Codec: "opus", Rate: 16000, Channel: 1}},
+	}
+	for _, c := range cases {
+		f, err := ProbeAudio(context.Background(), srv.URL+c.path, c.contentType)
+		if err != nil || *f != c.want {
+			t.Fatalf("probe %s: unexpected format %+v, %v", c.path, f, err)
+		}
+	}
+	if _, err := ProbeAudio(context.Background(), srv.URL+"/1.pcm", ""); !errors.Is(err, UnsupportedAudio) { // 无法识别
+		t.Fatalf("unexpected err %v", err)
+	}
+	for _, path := range []string{"/empty", "/missing"} { // 空文件或文件不存在
+		if _, err := ProbeAudio(context.Background(), srv.URL+path, ""); !errors.Is(err, InvalidAudio) {
+			t.Fatalf("probe %s: unexpected err %v", path, err)
+		}
+	}
+
+	v, o := NewVolcengine("app", "access"), NewOpenAI("http://localhost", "key", "")
+	if v.Supports(&AudioFormat{Format: "m4a"}) || !o.Supports(&AudioFormat{Format: "m4a"}) || o.Supports(&defaultRaw) {
+		t.Fatal("unexpected supported formats")
+	}
+}
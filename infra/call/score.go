@@ -0,0 +1,168 @@
+package call
+
+import (
+	"cmp"
+	"errors"
+	"github.com/cloudwego/eino/components/prompt"
+	"github.com/cloudwego/eino/schema"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/config"
+	"golang.org/x/net/context"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// 按评分细则将朗读的各项表现合成0-100的总分
+// 准确度: 朗读的内容中读对的比例, 误读与多读扣分, 声调错误按minorWeight扣分, 同音字视为正确
+// 完整度: 原文中没有漏读的比例
+// 流利度: 语速达到要求时满分, 不足时按比例扣分, 每次明显犹豫再扣除固定的分数
+// 表现力: 可选, 由大模型根据原文, 朗读文本与分析结果给出
+// 总分为各项按权重的加权平均, 缺少的项(没有分句信息, 大模型评分失败)不计入
+
+type (
+	// Band 等级, 总分不低于Min时属于该等级
+	Band struct {
+		Min  int    `json:"min"`
+		Name string `json:"name"`
+	}
+	// Rubric 评分细则
+	Rubric struct {
+		Accuracy       float64            // 准确度的权重
+		Completeness   float64            // 完整度的权重
+		Fluency        float64            // 流利度的权重
+		Expressiveness float64            // 表现力的权重
+		Speed          map[string]float64 // 各语言流利度满分的最低语速
+		Hesitation     float64            // 每次明显犹豫扣除的流利度分数
+		Bands          []Band             // 等级, 按Min从高到低排列
+	}
+	// Score 评分结果, 各项为0-100分, 缺少的项为nil
+	Score struct {
+		Accuracy       float64  `json:"accuracy"`
+		Completeness   float64  `json:"completeness"`
+		Fluency        *float64 `json:"fluency,omitempty"`
+		Expressiveness *float64 `json:"expressiveness,omitempty"`
+		Total          int      `json:"total"`
+		Grade          string   `json:"grade"`
+	}
+)
+
+var (
+	rubric        *Rubric
+	rubricOnce    sync.Once
+	expressPrompt prompt.ChatTemplate
+	grading       = regexp.MustCompile(`\d+(\.\d+)?`)
+	defaultBands  = []Band{{90, "优秀"}, {75, "良好"}, {60, "合格"}, {0, "待提高"}}
+	NoGrade       = errors.New("大模型未给出有效的表现力评分")
+)
+
+// GetRubric 根据配置创建评分细则
+func GetRubric() *Rubric {
+	rubricOnce.Do(func() {
+		conf := config.GetConfig().Score
+		rubric = &Rubric{
+			Accuracy:     conf.Accuracy,
+			Completeness: conf.Completeness,
+			Fluency:      conf.Fluency,
+			Speed:        map[string]float64{LangZH: conf.Speed, LangEN: conf.SpeedEN},
+			Hesitation:   conf.Hesitation,
+			Bands:        defaultBands,
+		}
+		if conf.Template != "" { // 没有提示词时不调用大模型
+			rubric.Expressiveness = conf.Expressiveness
+			expressPrompt = prompt.FromMessages(schema.FString, schema.UserMessage(conf.Template))
+		}
+		if len(conf.Grades) > 0 {
+			rubric.Bands = make([]Band, 0, len(conf.Grades))
+			for _, g := range conf.Grades {
+				rubric.Bands = append(rubric.Bands, Band(g))
+			}
+			slices.SortFunc(rubric.Bands, func(a, b Band) int { return cmp.Compare(b.Min, a.Min) })
+		}
+	})
+	return rubric
+}
+
+// Expressive 是否需要大模型给出表现力评分
+func (r *Rubric) Expressive() bool {
+	return r.Expressiveness > 0
+}
+
+// Rate 根据比较结果, 流利度与表现力打分, 没有原文时返回nil
+func (r *Rubric) Rate(c *Comparison, f *Fluency, expressiveness *float64) *Score {
+	if c == nil || c.OriginLen == 0 {
+		return nil
+	}
+	var wrong, deleted float64
+	for _, e := range c.Edits {
+		switch e.Op {
+		case OpSubstitute, OpInsert:
+			wrong++
+		case OpTone:
+			wrong += minorWeight
+		case OpDelete:
+			deleted++
+		}
+	}
+	s := &Score{Completeness: 100 * (1 - deleted/float64(c.OriginLen))}
+	if c.ReadingLen > 0 {
+		s.Accuracy = clamp(100 * (1 - wrong/float64(c.ReadingLen)))
+	}
+	if f != nil {
+		fluency := 100.0
+		if speed := r.Speed[f.Language]; speed > 0 && f.Speed < speed {
+			fluency *= f.Speed / speed
+		}
+		fluency = clamp(fluency - r.Hesitation*float64(f.Hesitations))
+		s.Fluency = &fluency
+	}
+	if expressiveness != nil && r.Expressive() {
+		s.Expressiveness = expressiveness
+	}
+
+	// 加权平均, 缺少的项不计入
+	var sum, weights float64
+	for _, item := range []struct {
+		score  *float64
+		weight float64
+	}{{&s.Accuracy, r.Accuracy}, {&s.Completeness, r.Completeness}, {s.Fluency, r.Fluency}, {s.Expressiveness, r.Expressiveness}} {
+		if item.score != nil && item.weight > 0 {
+			sum += *item.score * item.weight
+			weights += item.weight
+		}
+	}
+	if weights > 0 {
+		s.Total = int(math.Round(sum / weights))
+	}
+	for _, band := range r.Bands {
+		if s.Total >= band.Min {
+			s.Grade = band.Name
+			break
+		}
+	}
+	return s
+}
+
+// Express 由大模型给出表现力评分, 提示词的变量与评语相同, 取回复中的第一个数字
+func Express(ctx context.Context, origin, reading string, comparison *Comparison, fluency *Fluency) (float64, error) {
+	initComment()
+	GetRubric()
+	msgs, err := expressPrompt.Format(ctx, formatInfos(origin, reading, comparison, fluency))
+	if err != nil {
+		return 0, err
+	}
+	resp, err := generate(ctx, msgs)
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseFloat(grading.FindString(resp.Content), 64)
+	if err != nil || v > 100 {
+		return 0, NoGrade
+	}
+	return v, nil
+}
+
+func clamp(v float64) float64 {
+	return min(max(v, 0), 100)
+}
@@ -0,0 +1,31 @@
+package call
+
+import (
+	"math"
+	"testing"
+)
+
+func TestRate(t *testing.T) {
+	r := &Rubric{Accuracy: 50, Completeness: 30, Fluency: 20, Speed: map[string]float64{LangZH: 150}, Hesitation: 10, Bands: defaultBands}
+	// 一处误读, 一处漏读, 共10字
+	c := Compare("床前明月光疑是地上霜", "床前明月光疑似地霜", LangZH, false)
+	s := r.Rate(c, nil, nil)
+	if math.Abs(s.Accuracy-100*8.0/9) > 1e-9 || s.Completeness != 90 || s.Fluency != nil || s.Total != 89 || s.Grade != "良好" {
+		t.Fatalf("unexpected score %+v", s)
+	}
+
+	// 语速不足与犹豫扣除流利度, 未配置权重的表现力不计入
+	expressiveness := 100.0
+	s = r.Rate(c, &Fluency{Language: LangZH, Speed: 75, Hesitations: 2}, &expressiveness)
+	if *s.Fluency != 30 || s.Expressiveness != nil || s.Total != 77 || s.Grade != "良好" {
+		t.Fatalf("unexpected score %+v", s)
+	}
+
+	// 没有原文时不评分, 什么都没有读为0分
+	if s = r.Rate(Compare("", "床前明月光", LangZH, false), nil, nil); s != nil {
+		t.Fatalf("unexpected score %+v", s)
+	}
+	if s = r.Rate(Compare("床前明月光", "", LangZH, false), nil, nil); s.Total != 0 || s.Grade != "待提高" {
+		t.Fatalf("unexpected score %+v", s)
+	}
+}
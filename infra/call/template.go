@@ -0,0 +1,172 @@
+package call
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"github.com/cloudwego/eino/components/prompt"
+	"github.com/cloudwego/eino/schema"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/config"
+	"hash/fnv"
+	"math"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+// 评语提示词模板的注册表
+// 模板由名称与版本标识, 同一语言可以有多个模板, 按权重分配流量以对比不同提示词的效果
+// 分配按学生或答案id与模板标识的加权哈希(rendezvous hashing), 同一个key总是分配到同一个模板, 重试与重新生成时不会更换
+// 分配与模板的配置顺序无关, 重新加载时新增模板只分走部分key, 下线模板只迁移原属于它的key
+// 权重为0的模板不再分配, 保留用于查询历史记录
+// 没有配置Comment.Templates时, 由Comment与Comment.English的提示词生成default模板, 与之前的行为一致
+// ReloadTemplates重新读取配置文件并整体替换注册表, 构建失败时保留原注册表
+
+type (
+	// Template 一个版本的评语提示词模板
+	Template struct {
+		Name     string
+		Version  int
+		Language string // 适用的语言, 为空时适用于所有语言
+		Weight   int    // 流量权重
+		Script   string // 评语的书写系统, 为空时使用检查规则的配置
+		chat     prompt.ChatTemplate
+	}
+	// Registry 模板注册表
+	Registry struct {
+		templates []*Template
+	}
+)
+
+var (
+	registry      atomic.Pointer[Registry]
+	registryOnce  sync.Once
+	NoTemplate    = errors.New("没有可用的评语模板")
+	DuplicateName = errors.New("模板的名称与版本重复")
+)
+
+// GetTemplates 根据配置创建模板注册表
+func GetTemplates() *Registry {
+	registryOnce.Do(func() {
+		r, err := newRegistry(config.GetConfig())
+		if err != nil {
+			panic("register comment template err:" + err.Error())
+		}
+		registry.CompareAndSwap(nil, r)
+	})
+	return registry.Load()
+}
+
+// ReloadTemplates 重新读取配置文件中的模板并替换注册表, 已分配给任务的模板不受影响
+func ReloadTemplates() (*Registry, error) {
+	c, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	r, err := newRegistry(c)
+	if err != nil {
+		return nil, err
+	}
+	registryOnce.Do(func() {}) // 之后GetTemplates不再使用启动时的配置
+	registry.Store(r)
+	return r, nil
+}
+
+// newRegistry 由配置创建模板注册表
+func newRegistry(c *config.Config) (*Registry, error) {
+	conf, r := c.Comment, &Registry{}
+	for _, t := range conf.Templates {
+		tpl := NewTemplate(t.Name, t.Version, t.Language, t.Weight, cmp.Or(t.Assistant, conf.Assistant), t.Template)
+		tpl.Script = t.Script
+		if err := r.Register(tpl); err != nil {
+			return nil, err
+		}
+	}
+	if len(conf.Templates) > 0 {
+		return r, nil
+	}
+	if conf.Template != "" {
+		_ = r.Register(NewTemplate("default", 1, "", 1, conf.Assistant, conf.Template))
+	}
+	if conf.English.Template != "" { // 英文原文使用单独的提示词
+		_ = r.Register(NewTemplate("default-en", 1, LangEN, 1, cmp.Or(conf.English.Assistant, conf.Assistant), conf.English.Template))
+	}
+	return r, nil
+}
+
+// NewTemplate 创建模板, assistant与template中可以使用{origin}{reading}{info}
+func NewTemplate(name string, version int, lang string, weight int, assistant, template string) *Template {
+	return &Template{Name: name, Version: version, Language: lang, Weight: weight,
+		chat: prompt.FromMessages(schema.FString, schema.AssistantMessage(assistant, nil), schema.UserMessage(template))}
+}
+
+// ID 模板的标识, 记录在分析结果中
+func (t *Template) ID() string {
+	return fmt.Sprintf("%s@v%d", t.Name, t.Version)
+}
+
+// Register 注册模板, 名称与版本不能重复
+func (r *Registry) Register(t *Template) error {
+	if r.Lookup(t.ID()) != nil {
+		return fmt.Errorf("%w: %s", DuplicateName, t.ID())
+	}
+	r.templates = append(r.templates, t)
+	return nil
+}
+
+// List 注册的全部模板
+func (r *Registry) List() []*Template {
+	return slices.Clone(r.templates)
+}
+
+// Lookup 按标识查询模板, 不存在时返回nil
+func (r *Registry) Lookup(id string) *Template {
+	for _, t := range r.templates {
+		if t.ID() == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// Pick 按key与模板标识的哈希在适用于lang的模板中按权重选择一个
+// 指定了该语言的模板优先于通用的模板, 其次为中文的模板, 全部权重为0时选择第一个, 没有模板时返回nil
+func (r *Registry) Pick(lang, key string) *Template {
+	var candidates []*Template
+	for _, t := range r.templates {
+		if t.Language == lang {
+			candidates = append(candidates, t)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, t := range r.templates {
+			if t.Language == "" {
+				candidates = append(candidates, t)
+			}
+		}
+	}
+	if len(candidates) == 0 && lang != LangZH { // 与之前一致, 没有单独的模板时使用中文的模板
+		return r.Pick(LangZH, key)
+	} else if len(candidates) == 0 {
+		return nil
+	}
+
+	// 每个模板的得分为weight / -ln(u), u为key与模板标识哈希到(0, 1)的值, 选择得分最高的模板的概率与权重成正比
+	var picked *Template
+	var best float64
+	for _, t := range candidates {
+		if t.Weight <= 0 {
+			continue
+		}
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key + "/" + t.ID()))
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		if score := float64(t.Weight) / -math.Log(u); picked == nil || score > best {
+			picked, best = t, score
+		}
+	}
+	if picked == nil { // 全部权重为0
+		return candidates[0]
+	}
+	return picked
+}
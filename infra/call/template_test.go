@@ -0,0 +1,78 @@
+package call
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestRegistryPick(t *testing.T) {
+	r := &Registry{}
+	for _, tpl := range []*Template{
+		NewTemplate("warm", 1, "", 0, "", "{origin}"),
+		NewTemplate("warm", 2, "", 3, "", "{origin}"),
+		NewTemplate("strict", 1, "", 1, "", "{origin}"),
+	} {
+		if err := r.Register(tpl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Register(NewTemplate("warm", 2, LangZH, 1, "", "")); !errors.Is(err, DuplicateName) {
+		t.Fatalf("expected duplicate, got %v", err)
+	}
+
+	// 同一个key总是分配到同一个模板, 权重为0的模板不再分配, 分配比例接近权重
+	counts := make(map[string]int)
+	for i := range 4000 {
+		key := fmt.Sprintf("student-%d", i)
+		tpl := r.Pick(LangZH, key)
+		if r.Pick(LangZH, key) != tpl {
+			t.Fatalf("assignment of %s is not deterministic", key)
+		}
+		counts[tpl.ID()]++
+	}
+	if counts["warm@v1"] != 0 || counts["warm@v2"] < 2800 || counts["warm@v2"] > 3200 {
+		t.Fatalf("unexpected assignment %v", counts)
+	}
+
+	// 指定语言的模板优先
+	_ = r.Register(NewTemplate("english", 1, LangEN, 1, "", ""))
+	if tpl := r.Pick(LangEN, "student-1"); tpl.ID() != "english@v1" {
+		t.Fatalf("unexpected template %s", tpl.ID())
+	}
+	if tpl := (&Registry{}).Pick(LangEN, "student-1"); tpl != nil {
+		t.Fatalf("unexpected template %s", tpl.ID())
+	}
+}
+
+func TestRegistryReassign(t *testing.T) {
+	build := func(tpls ...*Template) *Registry {
+		r := &Registry{}
+		for _, tpl := range tpls {
+			_ = r.Register(tpl)
+		}
+		return r
+	}
+	warm, strict := NewTemplate("warm", 1, "", 1, "", ""), NewTemplate("strict", 1, "", 1, "", "")
+	before, reordered := build(warm, strict), build(strict, warm)
+	after := build(warm, strict, NewTemplate("brief", 1, "", 1, "", ""))
+
+	// 重新加载后分配与配置顺序无关, 新增模板只分走部分key
+	moved := 0
+	for i := range 3000 {
+		key := fmt.Sprintf("student-%d", i)
+		old := before.Pick(LangZH, key)
+		if reordered.Pick(LangZH, key).ID() != old.ID() {
+			t.Fatalf("assignment of %s depends on order", key)
+		}
+		if tpl := after.Pick(LangZH, key); tpl.ID() != old.ID() {
+			if tpl.ID() != "brief@v1" {
+				t.Fatalf("%s moved from %s to %s", key, old.ID(), tpl.ID())
+			}
+			moved++
+		}
+	}
+	if moved < 800 || moved > 1200 {
+		t.Fatalf("unexpected moved %d", moved)
+	}
+}
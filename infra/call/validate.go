@@ -0,0 +1,169 @@
+package call
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/zeromicro/go-zero/core/logx"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/config"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 提交asr之前校验录音, 避免为无效的录音付费
+// 文件大小来自Range响应的Content-Range, 时长根据文件头估算: wav/pcm按数据大小与字节率
+// mp3按Xing/Info/VBRI头中的帧数, 没有帧数时只有确定为固定比特率才按首帧的比特率估算, 否则时长未知, 不做时长校验
+// wav/pcm会下载整个文件计算音量, 判断是否接近静音. 其他格式无法在不解码的情况下计算, 不做判断
+// 校验失败返回InvalidAudio, 重试无法恢复
+
+var (
+	InvalidAudio = errors.New("[audio validate] invalid recording")
+	silenceFloor = -120.0 // 全部为零的采样视为该音量(dBFS)
+	checker      *AudioCheck
+	checkerOnce  sync.Once
+)
+
+type (
+	// AudioFile 录音文件的信息, 未知的信息为零值
+	AudioFile struct {
+		AudioFormat
+		Size     int64         `json:"size"`     // 文件字节数
+		Duration time.Duration `json:"duration"` // 估算的时长
+		Level    float64       `json:"level"`    // 音量(dBFS), 只计算wav/pcm
+	}
+	// AudioCheck 录音的校验规则, 为零的规则不生效
+	AudioCheck struct {
+		MinSize     int64         // 最小字节数
+		MaxSize     int64         // 最大字节数, 同时限制计算音量时下载的字节数
+		MinDuration time.Duration // 最短时长
+		MaxDuration time.Duration // 最长时长
+		Tolerance   float64       // 估算时长与记录时长的最大相对偏差
+		Silence     float64       // 音量低于该值视为静音(dBFS)
+	}
+)
+
+// GetAudioCheck 根据配置创建校验规则
+func GetAudioCheck() *AudioCheck {
+	checkerOnce.Do(func() {
+		conf := config.GetConfig().Validate
+		checker = &AudioCheck{
+			MinSize:     conf.MinSize,
+			MaxSize:     conf.MaxSize,
+			MinDuration: time.Duration(conf.MinDuration * float64(time.Second)),
+			MaxDuration: time.Duration(conf.MaxDuration * float64(time.Second)),
+			Tolerance:   conf.Tolerance,
+			Silence:     conf.Silence,
+		}
+	})
+	return checker
+}
+
+// InspectAudio 探测录音的格式并估算大小, 时长与音量, contentType为答案中记录的MIME类型, 可以为空
+func (c *AudioCheck) InspectAudio(ctx context.Context, url, contentType string) (*AudioFile, error) {
+	f, head, header, err := probe(ctx, url, contentType)
+	if err != nil {
+		return nil, err
+	}
+	file := &AudioFile{AudioFormat: *f, Size: contentSize(header)}
+	offset, size := 0, file.Size
+	switch {
+	case f.Format == "wav":
+		var n uint32
+		if offset, n = wavData(head); n > 0 && n != math.MaxUint32 { // 流式写入的wav数据块大小可能未填写
+			size = int64(n)
+		} else if size > 0 {
+			size -= int64(offset)
+		}
+	case f.Format == "mp3":
+		offset = min(id3End(head), int(size))
+		size -= int64(offset)
+	}
+	if f.Format == "mp3" && f.frames > 0 && f.Rate > 0 {
+		samples := 576 // 每帧的采样数, MPEG1为1152, MPEG2/2.5为576
+		if f.Rate >= 32000 {
+			samples = 1152
+		}
+		file.Duration = time.Duration(float64(f.frames*samples) / float64(f.Rate) * float64(time.Second))
+	} else if f.Format == "mp3" && f.cbr && f.Bitrate > 0 {
+		file.Duration = time.Duration(float64(size*8) / float64(f.Bitrate) * float64(time.Second))
+	} else if rate := f.Rate * f.Channel * f.Bits / 8; (f.Format == "wav" || f.Format == "raw") && rate > 0 {
+		file.Duration = time.Duration(float64(size) / float64(rate) * float64(time.Second))
+	}
+
+	// 计算pcm的音量, 文件过大时不下载, 由大小校验拒绝
+	if (f.Format == "wav" || f.Format == "raw") && f.Codec == "raw" && f.Bits == 16 &&
+		c.Silence < 0 && file.Size > int64(offset) && (c.MaxSize <= 0 || file.Size <= c.MaxSize) {
+		data, _, err := readRange(ctx, url, offset, int(file.Size)-offset)
+		if err != nil {
+			logx.Errorf("[audio validate] download %s err: %s", url, err)
+			return nil, err
+		}
+		file.Level = level(data)
+	}
+	return file, nil
+}
+
+// Validate 校验录音, expected为答案中记录的时长, 为零时不比较
+func (c *AudioCheck) Validate(f *AudioFile, expected time.Duration) error {
+	switch {
+	case f.Size > 0 && c.MinSize > 0 && f.Size < c.MinSize:
+		return fmt.Errorf("%w: size %d bytes is too small", InvalidAudio, f.Size)
+	case f.Size > 0 && c.MaxSize > 0 && f.Size > c.MaxSize:
+		return fmt.Errorf("%w: size %d bytes is too large", InvalidAudio, f.Size)
+	case f.Duration > 0 && c.MinDuration > 0 && f.Duration < c.MinDuration:
+		return fmt.Errorf("%w: duration %s is too short", InvalidAudio, f.Duration)
+	case f.Duration > 0 && c.MaxDuration > 0 && f.Duration > c.MaxDuration:
+		return fmt.Errorf("%w: duration %s is too long", InvalidAudio, f.Duration)
+	case f.Duration > 0 && expected > 0 && c.Tolerance > 0 &&
+		math.Abs(float64(f.Duration-expected)) > c.Tolerance*float64(expected)+float64(time.Second):
+		return fmt.Errorf("%w: duration %s mismatches audio time %s", InvalidAudio, f.Duration, expected)
+	case f.Level < 0 && f.Level < c.Silence:
+		return fmt.Errorf("%w: level %.1f dBFS is near silence", InvalidAudio, f.Level)
+	}
+	return nil
+}
+
+// contentSize 根据响应头获取文件大小, 未知时返回0
+func contentSize(header http.Header) int64 {
+	if r := header.Get("Content-Range"); r != "" { // bytes 0-4095/12345
+		if i := strings.LastIndex(r, "/"); i >= 0 {
+			size, _ := strconv.ParseInt(r[i+1:], 10, 64)
+			return size
+		}
+		return 0
+	}
+	size, _ := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	return size
+}
+
+// wavData 查找data块, 返回数据开始的位置与数据块大小, 未找到时返回标准文件头的长度
+// 块大小按文件中的uint32处理, 0xFFFFFFFF表示大小未知, 跳过块时按int64计算, 避免32位平台溢出
+func wavData(head []byte) (offset int, size uint32) {
+	for i := int64(12); i+8 <= int64(len(head)); {
+		id, n := string(head[i:i+4]), binary.LittleEndian.Uint32(head[i+4:i+8])
+		if id == "data" {
+			return int(i) + 8, n
+		}
+		i += 8 + int64(n) + int64(n%2)
+	}
+	return 44, 0
+}
+
+// level 计算16位小端pcm的均方根音量(dBFS)
+func level(data []byte) float64 {
+	var sum float64
+	n := len(data) / 2
+	for i := 0; i < n; i++ {
+		v := float64(int16(binary.LittleEndian.Uint16(data[2*i:])))
+		sum += v * v
+	}
+	if n == 0 || sum == 0 {
+		return silenceFloor
+	}
+	return max(20*math.Log10(math.Sqrt(sum/float64(n))/32768), silenceFloor)
+}
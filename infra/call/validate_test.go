@@ -0,0 +1,91 @@
+package call
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// wavFile 构造一个16000Hz单声道的wav文件, 内容为指定振幅的正弦波
+func wavFile(d time.Duration, amplitude float64) []byte {
+	n := int(d.Seconds() * 16000)
+	header := wavHeader(16000, 16, 1)
+	binary.LittleEndian.PutUint32(header[len(header)-4:], uint32(n*2))
+	b := bytes.NewBuffer(header)
+	for i := range n {
+		_ = binary.Write(b, binary.LittleEndian, int16(amplitude*math.Sin(float64(i)/10)))
+	}
+	return b.Bytes()
+}
+
+// mp3File 构造一个32000字节的128kbps, 48000Hz立体声mp3, tag与flags为首帧side info之后的Xing/Info头, tag为空时没有该头
+func mp3File(tag string, flags, frames uint32) []byte {
+	data := append([]byte{0xFF, 0xFB, 0x94, 0x64}, make([]byte, 32000-4)...)
+	if tag != "" {
+		copy(data[36:], tag)
+		binary.BigEndian.PutUint32(data[40:], flags)
+		binary.BigEndian.PutUint32(data[44:], frames)
+	}
+	return data
+}
+
+func TestValidateAudio(t *testing.T) {
+	files := map[string][]byte{
+		"/speech.wav": wavFile(3*time.Second, 8000),
+		"/silent.wav": wavFile(3*time.Second, 10),
+		"/short.wav":  wavFile(200*time.Millisecond, 8000),
+		"/1.mp3":      mp3File("Info", 0, 0),   // 固定比特率, 按比特率估算约2秒
+		"/vbr.mp3":    mp3File("Xing", 1, 125), // 可变比特率, 125帧共3秒
+		"/raw.mp3":    mp3File("", 0, 0),       // 没有头, 时长未知
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(file))
+	}))
+	defer srv.Close()
+
+	check := &AudioCheck{MinSize: 1024, MaxSize: 1 << 20, MinDuration: time.Second, MaxDuration: time.Minute, Tolerance: 0.5, Silence: -50}
+	cases := []struct {
+		path     string
+		expected time.Duration
+		valid    bool
+	}{
+		{"/speech.wav", 3 * time.Second, true},
+		{"/speech.wav", 20 * time.Second, false}, // 时长与记录不符
+		{"/silent.wav", 3 * time.Second, false},
+		{"/short.wav", 0, false},
+		{"/1.mp3", 2 * time.Second, true},
+		{"/1.mp3", 10 * time.Second, false},
+		{"/vbr.mp3", 3 * time.Second, true},
+		{"/vbr.mp3", 10 * time.Second, false},
+		{"/raw.mp3", 10 * time.Second, true}, // 不能确定比特率时不做时长校验
+	}
+	for _, c := range cases {
+		f, err := check.InspectAudio(context.Background(), srv.URL+c.path, "")
+		if err != nil {
+			t.Fatalf("inspect %s err: %v", c.path, err)
+		}
+		if err = check.Validate(f, c.expected); (err == nil) != c.valid || (err != nil && !errors.Is(err, InvalidAudio)) {
+			t.Fatalf("validate %s with %s: unexpected err %v, file %+v", c.path, c.expected, err, f)
+		}
+	}
+	if f, _ := check.InspectAudio(context.Background(), srv.URL+"/speech.wav", ""); f.Duration != 3*time.Second || f.Size != int64(len(files["/speech.wav"])) {
+		t.Fatalf("unexpected file %+v", f)
+	}
+	if f, _ := check.InspectAudio(context.Background(), srv.URL+"/vbr.mp3", ""); f.Duration != 3*time.Second {
+		t.Fatalf("unexpected vbr file %+v", f)
+	}
+	if _, err := check.InspectAudio(context.Background(), srv.URL+"/missing.wav", ""); !errors.Is(err, InvalidAudio) {
+		t.Fatalf("unexpected err %v", err)
+	}
+}
@@ -0,0 +1,285 @@
+package call
+
+import (
+	"context"
+	"errors"
+	"github.com/avast/retry-go"
+	"github.com/zeromicro/go-zero/core/logx"
+	"net/http"
+	"time"
+)
+
+// 火山引擎录音文件识别大模型, 先提交任务再轮询查询结果
+// 任务状态通过响应头中的X-Api-Status-Code返回
+// 配置了回调地址时, 提交后等待回调通知再查询, 等待期间按较长的间隔查询, 超时未收到回调则退回轮询
+
+var (
+	submitEndpoint     = "https://openspeech.bytedance.com/api/v3/auc/bigmodel/submit"
+	queryEndpoint      = "https://openspeech.bytedance.com/api/v3/auc/bigmodel/query"
+	modelName          = "bigmodel"
+	modelVersion       = "400"
+	resourceID         = "volc.bigasr.auc"
+	VolcengineProvider = "volcengine" // asr服务提供方
+	queryInterval      = 3            // 每三秒查询一次
+	callbackTimeout    = 600          // 等待回调的秒数, 超时后轮询
+	callbackPoll       = 30           // 等待回调期间查询的间隔秒数, 回调可能被转发到其他实例
+)
+
+type (
+	// Volcengine 火山引擎asr服务
+	Volcengine struct {
+		SubmitURL string
+		QueryURL  string
+		AppKey    string
+		AccessKey string
+		Interval  time.Duration // 查询间隔
+		Callback  string        // 回调地址, 为空时只轮询
+		Timeout   time.Duration // 等待回调的时长
+		Poll      time.Duration // 等待回调期间的查询间隔
+	}
+	// volcQuery 查询接口的响应, 任务未完成时为空
+	volcQuery struct {
+		AudioInfo struct {
+			Duration int `json:"duration"` // 音频时长(毫秒)
+		} `json:"audio_info"`
+		Result struct {
+			Text       string          `json:"text"`
+			Additions  map[string]any  `json:"additions"` // 附加信息, 如duration, 值的类型不固定
+			Utterances []volcUtterance `json:"utterances"`
+		} `json:"result"`
+	}
+	volcUtterance struct {
+		Text      string         `json:"text"`
+		StartTime int            `json:"start_time"`
+		EndTime   int            `json:"end_time"`
+		Definite  bool           `json:"definite"`  // 是否为确定的分句
+		Additions map[string]any `json:"additions"` // 附加信息, 如fixed_prefix_result, 值的类型不固定
+		Words     []volcWord     `json:"words"`
+	}
+	volcWord struct {
+		Text          string  `json:"text"`
+		StartTime     int     `json:"start_time"`
+		EndTime       int     `json:"end_time"`
+		Confidence    float64 `json:"confidence"`
+		BlankDuration int     `json:"blank_duration"` // 与上一个词之间的空白时长
+	}
+)
+
+// NewVolcengine 创建火山引擎asr服务
+func NewVolcengine(appKey, accessKey string) *Volcengine {
+	return &Volcengine{
+		SubmitURL: submitEndpoint,
+		QueryURL:  queryEndpoint,
+		AppKey:    appKey,
+		AccessKey: accessKey,
+		Interval:  time.Duration(queryInterval) * time.Second,
+		Timeout:   time.Duration(callbackTimeout) * time.Second,
+		Poll:      time.Duration(callbackPoll) * time.Second,
+	}
+}
+
+// Recognize 提交任务并轮询结果, 任务从提交到查询结束占用asr限流器的一个并发槽位
+func (v *Volcengine) Recognize(ctx context.Context, t *FileAsrTask) (*ASRTaskResp, error) {
+	release, err := ASRLimiter().Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// 回调可能先于提交的响应到达, 需要在提交前登记
+	var done <-chan struct{}
+	if v.Callback != "" {
+		var cancel func()
+		done, cancel = callbacks.await(t.Uid)
+		defer cancel()
+	}
+
+	var ok bool
+	if ok, err = v.submit(ctx, t); err != nil { // 提交失败
+		logx.Errorf("[asr file task] submit err:%s", err)
+		return nil, err
+	} else if !ok {
+		return nil, ASRSubmitFailed
+	}
+	if done != nil {
+		var resp *ASRTaskResp
+		if resp, err = v.wait(ctx, t, done); resp != nil || err != nil {
+			return resp, err
+		}
+	}
+	return v.query(ctx, t)
+}
+
+// wait 等待回调通知, 期间每隔Poll查询一次, 查询到结果时直接返回
+// 收到回调或超时后返回nil, 由轮询查询结果
+func (v *Volcengine) wait(ctx context.Context, t *FileAsrTask, done <-chan struct{}) (*ASRTaskResp, error) {
+	timer, ticker := time.NewTimer(v.Timeout), time.NewTicker(v.Poll)
+	defer timer.Stop()
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return nil, nil
+		case <-timer.C:
+			logx.Infof("[asr file task] wait callback of %s timeout, fallback to query", t.Uid)
+			return nil, nil
+		case <-ticker.C:
+			if resp, finished, err := v.queryOnce(ctx, t); finished || err != nil {
+				return resp, err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Supports 支持wav/mp3/ogg容器与裸pcm, wav与pcm需为pcm编码, ogg需为opus编码
+func (v *Volcengine) Supports(f *AudioFormat) bool {
+	switch f.Format {
+	case "mp3":
+		return true
+	case "wav", "raw":
+		return f.Codec == "" || f.Codec == "raw"
+	case "ogg":
+		return f.Codec == "" || f.Codec == "opus"
+	}
+	return false
+}
+
+// submit 提交一个任务
+func (v *Volcengine) submit(ctx context.Context, t *FileAsrTask) (bool, error) {
+	var header http.Header
+	err := retry.Do(func() (err error) {
+		if err = ASRLimiter().Wait(ctx); err != nil {
+			return err
+		}
+		if header, _, err = GetHttpClient().PostWithHeader(ctx, v.SubmitURL, v.buildHeader(t), v.buildSubmit(t)); err != nil {
+			logx.Errorf("[asr file task]: post err: %s", err)
+			return err
+		}
+		logx.Infof("[asr file task]: log id: %s, status: code %s, message: %s", header.Get("X-Tt-Logid"), header.Get("X-Api-Status-Code"), header.Get("X-Api-Message"))
+		return nil
+	}, append(opts, retry.Context(ctx))...)
+	return IsASRSuccess(header.Get("X-Api-Status-Code")), err
+}
+
+// IsASRSuccess 判断是否提交成功
+func IsASRSuccess(code string) bool {
+	return code == "20000000"
+}
+
+// query 按Interval轮询结果
+func (v *Volcengine) query(ctx context.Context, t *FileAsrTask) (*ASRTaskResp, error) {
+	for {
+		if resp, finished, err := v.queryOnce(ctx, t); finished || err != nil {
+			return resp, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(v.Interval):
+		}
+	}
+}
+
+// queryOnce 查询一次结果, 任务仍在处理中时finished为false
+func (v *Volcengine) queryOnce(ctx context.Context, t *FileAsrTask) (*ASRTaskResp, bool, error) {
+	var header http.Header
+	var body *volcQuery
+	var raw []byte
+	if err := retry.Do(func() (err error) { // 单次请求失败重试
+		if err = ASRLimiter().Wait(ctx); err != nil {
+			return err
+		}
+		header, body, raw, err = PostAs[volcQuery](ctx, GetHttpClient(), v.QueryURL, v.buildHeader(t), nil)
+		if errors.Is(err, DecodeFailed) && !IsASRSuccess(header.Get("X-Api-Status-Code")) {
+			err = nil // 未完成或失败的任务不使用响应体
+		} else if err != nil {
+			logx.Errorf("[asr file task] query http err: %s", err)
+		}
+		return err
+	}, append(opts, retry.Context(ctx), retry.LastErrorOnly(true), retry.RetryIf(func(err error) bool {
+		return !errors.Is(err, DecodeFailed) // 响应与模型不符时重试无意义
+	}))...); err != nil { // 多次请求失败, 可能出现网络问题, 退出
+		logx.Errorf("[asr file task]: query retry too many times err: %s", err)
+		return nil, false, err
+	}
+	code := header.Get("X-Api-Status-Code")
+	if IsASRSuccess(code) { // 成功
+		resp := conv2ASRTaskResp(body)
+		resp.Raw = raw
+		resp.Biased = t.Origin != ""
+		return resp, true, nil
+	} else if !IsReQuery(code) { // ASR任务失败
+		logx.Errorf("[asr file task]: fail for the reason: %s %s", header.Get("X-Api-Message"), raw)
+		return nil, false, ASRTaskFailed
+	}
+	return nil, false, nil
+}
+
+// IsReQuery 是否需要重新查询
+func IsReQuery(code string) bool {
+	return code == "20000001" || code == "20000002"
+}
+
+func (v *Volcengine) buildSubmit(t *FileAsrTask) *Submit {
+	submit := &Submit{
+		User: SubmitUser{
+			UID: t.Uid,
+		},
+		Audio: Audio{
+			URL:     t.Url,
+			Format:  t.Format,
+			Codec:   t.Codec,
+			Rate:    t.Rate,
+			Bits:    t.Bits,
+			Channel: t.Channel,
+		},
+		Request: Request{
+			ModelName:      modelName,
+			ModelVersion:   modelVersion,
+			ShowUtterances: true, // 返回分句与分词的时间信息
+		},
+	}
+	if t.Origin != "" { // 使用原文中的热词与上下文提示识别
+		submit.Request.Context = buildVolcContext(t.Origin)
+	}
+	if v.Callback != "" { // 回调数据为带签名的任务id, 由回调接口校验后唤醒等待的任务
+		submit.Callback, submit.CallbackData = v.Callback, callbacks.sign(t.Uid)
+	}
+	return submit
+}
+
+func (v *Volcengine) buildHeader(t *FileAsrTask) http.Header {
+	return http.Header{
+		"X-Api-App-Key":     []string{v.AppKey},
+		"X-Api-Access-Key":  []string{v.AccessKey},
+		"X-Api-Resource-Id": []string{resourceID},
+		"X-Api-Request-Id":  []string{t.Uid},
+		"X-Api-Sequence":    []string{"-1"},
+	}
+}
+
+// parseVolcQuery 解析查询接口的原始响应
+func parseVolcQuery(raw []byte) (*ASRTaskResp, error) {
+	q, err := Decode[volcQuery](raw)
+	if err != nil {
+		return nil, err
+	}
+	return conv2ASRTaskResp(q), nil
+}
+
+func conv2ASRTaskResp(q *volcQuery) *ASRTaskResp {
+	resp := ASRTaskResp{Provider: VolcengineProvider, ModelVersion: modelName + "/" + modelVersion}
+	resp.AudioInfo.Duration = q.AudioInfo.Duration
+	resp.Result.Text = q.Result.Text
+	resp.Result.Utterances = make([]Utterance, 0, len(q.Result.Utterances))
+	for _, u := range q.Result.Utterances {
+		utterance := Utterance{Text: u.Text, StartTime: u.StartTime, EndTime: u.EndTime, Words: make([]Word, 0, len(u.Words))}
+		for _, w := range u.Words {
+			utterance.Words = append(utterance.Words, Word{Text: w.Text, StartTime: w.StartTime, EndTime: w.EndTime, Confidence: w.Confidence})
+		}
+		resp.Result.Utterances = append(resp.Result.Utterances, utterance)
+	}
+	return &resp
+}
@@ -9,32 +9,131 @@ import (
 var (
 	config *Config
 	once   sync.Once
+	path   = "D:\\Projects\\xhpolaris\\elion-reading-post\\etc\\config.yaml"
 )
 
 type Config struct {
 	service.ServiceConf
 	State string
 	DB    struct {
-		DSN string
+		DSN     string
+		Migrate bool `json:",optional"` // 启动时为答案表补充本服务维护的列(owner, lease_until), 为false时只检查, 缺少时退出
 	}
 	ASR struct {
-		AppKey    string
-		AccessKey string
+		Provider  string `json:",default=volcengine"` // asr服务: volcengine/openai
+		AppKey    string `json:",optional"`           // 火山引擎
+		AccessKey string `json:",optional"`           // 火山引擎
+		Callback  struct {
+			URL     string `json:",optional"`    // 本服务/asr/callback的外部地址, 为空时轮询查询结果
+			Timeout int    `json:",default=600"` // 等待回调的秒数, 超时后退回轮询
+			Poll    int    `json:",default=30"`  // 等待回调期间查询结果的间隔秒数, 回调被转发到其他实例时由查询兜底
+			Secret  string `json:",optional"`    // 回调签名的密钥, 多实例部署时需配置相同的值, 为空时随机生成
+		} `json:",optional"` // 火山引擎回调模式
+		Bias struct {
+			Enable  bool     `json:",optional"` // 是否使用原文提示asr
+			Include []string `json:",optional"` // 只对这些题目启用, 为空时对所有题目启用
+			Exclude []string `json:",optional"` // 对这些题目关闭, 用于对比有无提示的准确率
+		} `json:",optional"` // 使用原文中的热词与上下文提示asr
+		OpenAI struct {
+			BaseURL string // 服务地址, 不包括/v1
+			ApiKey  string
+			Model   string `json:",default=whisper-1"`
+		} `json:",optional"` // 兼容OpenAI接口的asr服务
 	}
+	Validate struct {
+		MinSize     int64   `json:",default=1024"`          // 录音的最小字节数
+		MaxSize     int64   `json:",default=52428800"`      // 录音的最大字节数, 同时限制计算音量时下载的字节数
+		MinDuration float64 `json:",default=1"`             // 最短时长(秒)
+		MaxDuration float64 `json:",default=900"`           // 最长时长(秒)
+		Tolerance   float64 `json:",default=0.5"`           // 估算时长与AudioTime(秒)的最大相对偏差
+		Silence     float64 `json:",default=-50"`           // 音量低于该值视为静音(dBFS), 只判断wav/pcm
+		Comment     string  `json:",default=录音无效，请重新录制后提交"` // 录音无效时写入的评价
+	} `json:",optional"` // 提交asr之前校验录音, 为零的规则不生效
 	Comment struct {
-		Assistant string
-		Template  string
+		Assistant string `json:",optional"` // 没有配置Templates时作为default模板
+		Template  string `json:",optional"`
 		ApiKey    string
 		BaseURL   string
+		English   struct {
+			Assistant string `json:",optional"` // 为空时使用中文的Assistant
+			Template  string `json:",optional"`
+		} `json:",optional"` // 英文原文的提示词, 为空时使用中文的提示词
+		Language  string `json:",optional"` // 原文表中语言(zh/en)的列名, 为空时根据原文检测
+		Templates []struct {
+			Name      string
+			Version   int
+			Language  string `json:",optional"` // 适用的语言(zh/en), 为空时适用于所有语言
+			Assistant string `json:",optional"` // 为空时使用Comment.Assistant
+			Template  string // 可使用{origin}{reading}{info}
+			Weight    int    `json:",default=1"`                      // 流量权重, 为0时不再分配
+			Script    string `json:",optional,options=han|latin|any"` // 评语的书写系统, 为空时使用Guard.Script
+		} `json:",optional"` // 带版本的提示词模板, 同一语言的多个模板按权重分配, 用于对比效果
+		Assign   string `json:",default=student,options=student|answer"` // 模板的分配依据: 按学生或按答案id哈希
+		Attempts int    `json:",default=3"`                              // 评语不符合格式或未通过检查时最多生成的次数
+		Guard    struct {
+			MinLength int      `json:",default=20"`                     // 展开后的最少字符数
+			MaxLength int      `json:",default=500"`                    // 展开后的最多字符数
+			Script    string   `json:",optional,options=han|latin|any"` // 评语的书写系统, 为空时按原文的语言, 中文为han, 英文为latin
+			MinScript float64  `json:",default=0.6"`                    // 期望的书写系统在汉字与字母中的最低占比
+			Banned    []string `json:",optional"`                       // 禁用的词语, 不区分大小写
+			Fallback  string   `json:",default=你已经完成了这次朗读。请对照原文再读一遍，注意读准每个字，争取读得更流利。继续加油！"`
+		} `json:",optional"` // 评语写入前的检查, 为零的规则不生效, 未通过时重新生成, 次数用尽后使用兜底的Fallback
+		Pinyin bool `json:",optional"` // 中文按拼音比较, 同音字视为asr的识别差异, 只有声调不同的视为轻微错误
 	}
+	Score struct {
+		Accuracy       float64 `json:",default=50"`  // 准确度的权重
+		Completeness   float64 `json:",default=30"`  // 完整度的权重
+		Fluency        float64 `json:",default=20"`  // 流利度的权重
+		Expressiveness float64 `json:",optional"`    // 大模型给出的表现力的权重, 为零时不调用大模型
+		Template       string  `json:",optional"`    // 表现力评分的提示词, 可使用{origin}{reading}{info}, 为空时不调用大模型
+		Speed          float64 `json:",default=150"` // 中文流利度满分的最低语速(字/分钟)
+		SpeedEN        float64 `json:",default=90"`  // 英文流利度满分的最低语速(词/分钟)
+		Hesitation     float64 `json:",default=10"`  // 每次明显犹豫扣除的流利度分数
+		Grades         []struct {
+			Min  int    // 达到该等级的最低分
+			Name string // 等级名称
+		} `json:",optional"` // 等级划分, 为空时使用默认的优秀/良好/合格/待提高
+	} `json:",optional"` // 评分细则, 各项为0-100分, 按权重加权平均得到总分, 缺少的项不计入
 	Consumers int
-	Expire    int
+	Pipeline  struct {
+		ASR     int `json:",optional"`   // asr阶段的消费者数量, 为空时使用Consumers
+		Comment int `json:",optional"`   // comment阶段的消费者数量, 为空时使用Consumers
+		Queue   int `json:",default=16"` // 阶段之间队列的容量, 小于1时按1处理
+	} `json:",optional"`
+	Priority struct {
+		Func     string  `json:",default=submitted"` // 优先级函数: submitted/deadline
+		Aging    float64 `json:",default=1"`         // 每等待一秒增加的优先级, 避免饥饿
+		Urgent   float64 `json:",default=86400"`     // 加急任务增加的优先级
+		Deadline string  `json:",optional"`          // 作业表中截止时间的列名, 为空时不查询
+	} `json:",optional"`
+	Autoscale struct {
+		Enable     bool    `json:",optional"`    // 是否启用自动扩缩容
+		Min        int     `json:",default=1"`   // 最少消费者数量, 不小于1
+		Max        int     `json:",default=64"`  // 最多消费者数量
+		Interval   int     `json:",default=30"`  // 调整间隔(秒)
+		Drain      int     `json:",default=300"` // 期望清空积压的时间(秒)
+		MaxErrRate float64 `json:",default=0.5"` // 上游错误率超过该值时缩容
+	} `json:",optional"`
+	Limits struct {
+		ASR struct {
+			QPS         float64 `json:",optional"` // 每秒请求数, 包括提交与查询
+			Concurrency int     `json:",optional"` // 同时进行中的任务数
+		} `json:",optional"`
+		Comment struct {
+			QPS         float64 `json:",optional"` // 每秒请求数
+			Concurrency int     `json:",optional"` // 同时进行中的请求数
+			TPM         int     `json:",optional"` // 每分钟token数
+		} `json:",optional"`
+	} `json:",optional"` // 上游服务的限流, 为零时不限制
+	Expire   int    // 租约时长(秒)
+	Instance string `json:",optional"` // 实例id, 用于区分租约持有者, 为空时使用主机名与进程号
+	ExitWait int    `json:",optional"` // 优雅退出时等待处理中任务的秒数
 }
 
 func GetConfig() *Config {
 	once.Do(func() {
-		c := new(Config)
-		if err := conf.Load("D:\\Projects\\xhpolaris\\elion-reading-post\\etc\\config.yaml", c); err != nil {
+		c, err := Load()
+		if err != nil {
 			panic("get config error:" + err.Error())
 		}
 		if err := c.SetUp(); err != nil {
@@ -44,3 +143,12 @@ func GetConfig() *Config {
 	})
 	return config
 }
+
+// Load 重新读取配置文件, 用于支持热加载的配置(如评语模板), 不影响GetConfig返回的配置
+func Load() (*Config, error) {
+	c := new(Config)
+	if err := conf.Load(path, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
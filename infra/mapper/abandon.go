@@ -0,0 +1,225 @@
+package mapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sync"
+	"time"
+)
+
+// 对应数据库中 table_elion_reading_post_abandon 表, 由本服务维护
+// 记录处理失败的答案, 用于持久化放弃状态与失败原因
+// record_id 对应答案表的id
+// stage 失败的阶段: validate/asr/comment/finish, 录音无效的记录以validate阶段直接丢弃
+// state 0 失败重试中, 1 已放弃, 2 已丢弃(永久放弃, 不再重试)
+// reason 丢弃原因
+
+type (
+	Abandon struct {
+		ID        int       `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+		RecordID  int       `gorm:"column:record_id;uniqueIndex" json:"record_id"`
+		Stage     string    `gorm:"column:stage;size:32" json:"stage"`
+		Error     string    `gorm:"column:error;type:text" json:"error"`
+		Times     int       `gorm:"column:times" json:"times"`
+		State     int       `gorm:"column:state;index" json:"state"`
+		Reason    string    `gorm:"column:reason;type:text" json:"reason"`
+		CreatedAt time.Time `gorm:"column:created_at" json:"created_at"`
+		UpdatedAt time.Time `gorm:"column:updated_at" json:"updated_at"`
+	}
+	// DeadLetter 放弃的记录及对应的答案信息
+	DeadLetter struct {
+		Abandon
+		StudentID     string    `gorm:"column:student_id" json:"student_id"`
+		QuestionID    string    `gorm:"column:question_id" json:"question_id"`
+		AnswerID      string    `gorm:"column:answer_id" json:"answer_id"`
+		Audio         string    `gorm:"column:audio" json:"audio"`
+		AudioTime     int       `gorm:"column:audio_time" json:"audio_time"`
+		AudioStatus   int       `gorm:"column:audio_status" json:"audio_status"`
+		SubmittedTime time.Time `gorm:"column:submitted_time" json:"submitted_time"`
+	}
+	// DeadLetterFilter 放弃记录的筛选条件, 零值的条件不生效
+	DeadLetterFilter struct {
+		State      *int      // 记录状态, 为nil时查询已放弃与已丢弃的记录
+		HomeworkID string    // 作业id
+		QuestionID string    // 题目id
+		Stage      string    // 失败的阶段
+		Error      string    // 失败原因包含的内容
+		Start, End time.Time // 最后一次失败的时间范围
+	}
+	AbandonMapper struct {
+		db *gorm.DB
+	}
+)
+
+const (
+	Failing   = 0
+	Abandoned = 1
+	Discarded = 2
+)
+
+const (
+	StageValidate = "validate"
+	StageASR      = "asr"
+	StageComment  = "comment"
+	StageScore    = "score"
+	StageFinish   = "finish"
+)
+
+var (
+	abandonMapper *AbandonMapper
+	abandonOnce   sync.Once
+	NoDeadLetter  = errors.New("放弃记录不存在")
+)
+
+// GetAbandonMapper 获取AbandonMapper单例, 与AnswerMapper共用连接
+func GetAbandonMapper() *AbandonMapper {
+	abandonOnce.Do(func() {
+		db := GetAnswerMapper().db
+		if err := db.AutoMigrate(&Abandon{}); err != nil {
+			panic(err)
+		}
+		abandonMapper = &AbandonMapper{db: db}
+	})
+	return abandonMapper
+}
+
+// Record 记录一次失败, abandoned为true时标记为已放弃
+func (m *AbandonMapper) Record(ctx context.Context, id int, stage, reason string, times int, abandoned bool) error {
+	state := Failing
+	if abandoned {
+		state = Abandoned
+	}
+	record := &Abandon{RecordID: id, Stage: stage, Error: reason, Times: times, State: state}
+	return m.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "record_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"stage", "error", "times", "state", "updated_at"}),
+	}).Create(record).Error
+}
+
+// Times 查询一批记录已失败的次数
+func (m *AbandonMapper) Times(ctx context.Context, ids []int) (map[int]int, error) {
+	var records []*Abandon
+	if err := m.db.WithContext(ctx).Where("record_id IN ?", ids).Find(&records).Error; err != nil {
+		return nil, err
+	}
+	times := make(map[int]int, len(records))
+	for _, r := range records {
+		times[r.RecordID] = r.Times
+	}
+	return times, nil
+}
+
+// Unabandon 删除放弃记录并将答案重新标记为未处理, 由fetch重新获取
+func (m *AbandonMapper) Unabandon(ctx context.Context, id int) (existed bool, err error) {
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		del := tx.WithContext(ctx).Where("record_id = ? AND state = ?", id, Abandoned).Delete(&Abandon{})
+		if del.Error != nil {
+			return del.Error
+		} else if del.RowsAffected == 0 {
+			return nil
+		}
+		existed = true
+		return tx.WithContext(ctx).Model(&Answer{}).Where("id = ? AND audio_status = ?", id, Handling).
+			Updates(unhandled(time.Now())).Error
+	})
+	return existed, err
+}
+
+// ListDeadLetters 分页查询放弃的记录, page从1开始
+func (m *AbandonMapper) ListDeadLetters(ctx context.Context, filter *DeadLetterFilter, page, size int) (letters []*DeadLetter, total int64, err error) {
+	if err = m.deadLetters(m.db.WithContext(ctx), filter).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = m.deadLetters(m.db.WithContext(ctx), filter).Select(deadLetterFields()).
+		Order(fmt.Sprintf("%s.updated_at DESC", Abandon{}.TableName())).
+		Offset((max(page, 1) - 1) * size).Limit(size).Scan(&letters).Error
+	return letters, total, err
+}
+
+// GetDeadLetter 查询一条放弃的记录
+func (m *AbandonMapper) GetDeadLetter(ctx context.Context, id int) (*DeadLetter, error) {
+	var letter DeadLetter
+	err := m.deadLetters(m.db.WithContext(ctx), &DeadLetterFilter{}).Select(deadLetterFields()).
+		Where(fmt.Sprintf("%s.record_id = ?", Abandon{}.TableName()), id).Take(&letter).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, NoDeadLetter
+	}
+	return &letter, err
+}
+
+// Retry 重试符合条件的已放弃记录, 删除放弃记录并将答案重新标记为未处理, 返回重试的记录id
+func (m *AbandonMapper) Retry(ctx context.Context, filter *DeadLetterFilter) (ids []int, err error) {
+	state, f := Abandoned, *filter // 只重试已放弃的记录, 不修改调用方的条件
+	f.State = &state
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		if err := m.deadLetters(tx.WithContext(ctx), &f).Pluck(fmt.Sprintf("%s.record_id", Abandon{}.TableName()), &ids).Error; err != nil {
+			return err
+		} else if len(ids) == 0 {
+			return nil
+		}
+		if err := tx.WithContext(ctx).Where("record_id IN ?", ids).Delete(&Abandon{}).Error; err != nil {
+			return err
+		}
+		return tx.WithContext(ctx).Model(&Answer{}).Where("id IN ? AND audio_status = ?", ids, Handling).
+			Updates(unhandled(time.Now())).Error
+	})
+	return ids, err
+}
+
+// Discard 永久丢弃一批已放弃的记录, 并记录丢弃原因, 返回丢弃的记录数
+func (m *AbandonMapper) Discard(ctx context.Context, ids []int, reason string) (int64, error) {
+	result := m.db.WithContext(ctx).Model(&Abandon{}).
+		Where("record_id IN ? AND state = ?", ids, Abandoned).
+		Updates(map[string]any{"state": Discarded, "reason": reason, "updated_at": time.Now()})
+	return result.RowsAffected, result.Error
+}
+
+// deadLetters 按条件筛选放弃记录并关联答案信息
+func (m *AbandonMapper) deadLetters(db *gorm.DB, filter *DeadLetterFilter) *gorm.DB {
+	abandon, answer := Abandon{}.TableName(), Answer{}.TableName()
+	db = db.Table(abandon).Joins(fmt.Sprintf("JOIN %s ON %s.id = %s.record_id", answer, answer, abandon))
+	if filter.State != nil {
+		db = db.Where(fmt.Sprintf("%s.state = ?", abandon), *filter.State)
+	} else {
+		db = db.Where(fmt.Sprintf("%s.state IN ?", abandon), []int{Abandoned, Discarded})
+	}
+	if filter.HomeworkID != "" {
+		db = db.Where(fmt.Sprintf("%s.question_id IN (?)", answer),
+			m.db.Table(Question2Homework).Select("question_id").Where("homework_id = ?", filter.HomeworkID))
+	}
+	if filter.QuestionID != "" {
+		db = db.Where(fmt.Sprintf("%s.question_id = ?", answer), filter.QuestionID)
+	}
+	if filter.Stage != "" {
+		db = db.Where(fmt.Sprintf("%s.stage = ?", abandon), filter.Stage)
+	}
+	if filter.Error != "" {
+		db = db.Where(fmt.Sprintf("%s.error LIKE ?", abandon), "%"+filter.Error+"%")
+	}
+	if !filter.Start.IsZero() {
+		db = db.Where(fmt.Sprintf("%s.updated_at >= ?", abandon), filter.Start)
+	}
+	if !filter.End.IsZero() {
+		db = db.Where(fmt.Sprintf("%s.updated_at < ?", abandon), filter.End)
+	}
+	return db
+}
+
+// deadLetterFields 放弃记录关联答案信息时查询的字段
+func deadLetterFields() string {
+	abandon, answer := Abandon{}.TableName(), Answer{}.TableName()
+	return fmt.Sprintf("%s.*, %s.student_id, %s.question_id, %s.answer_id, %s.audio, %s.audio_time, %s.audio_status, %s.submitted_time",
+		abandon, answer, answer, answer, answer, answer, answer, answer)
+}
+
+// abandoned 已放弃与已丢弃记录id的子查询
+func abandoned(tx *gorm.DB) *gorm.DB {
+	return tx.Model(&Abandon{}).Select("record_id").Where("state IN ?", []int{Abandoned, Discarded})
+}
+
+func (a Abandon) TableName() string {
+	return "table_elion_reading_post_abandon"
+}
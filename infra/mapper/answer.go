@@ -8,6 +8,7 @@ import (
 	"gitlab.aiecnu.net/elion/elion-reading-post/infra/config"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"sync"
 	"time"
 )
@@ -17,7 +18,11 @@ import (
 // audio 路径
 // audio_time 录音时长
 // audio_content_type 固定为MIME
-// audio_status 0 未提交, 1 提交未批改, 2 批改中, 3 批改完成
+// audio_status 0 未提交, 1 提交未批改, 2 批改中, 3 批改完成, 4 录音无效
+// 由本服务维护的字段有
+// owner 持有租约的实例id
+// lease_until 租约到期时间, 到期后记录可以被重新获取
+// 这两列不属于原表, 需要执行script/migrate.sql, 或配置DB.Migrate由服务启动时补充
 
 type (
 	Answer struct {
@@ -35,11 +40,17 @@ type (
 		AudioContentType string    `gorm:"column:audio_content_type;size:255" json:"audio_content_type"`
 		AudioStatus      int       `gorm:"column:audio_status" json:"audio_status"`
 		HandleTime       time.Time `gorm:"column:handle_time" json:"handle_time"`
+		Owner            string    `gorm:"column:owner;size:64;not null;default:''" json:"owner"`
+		LeaseUntil       time.Time `gorm:"column:lease_until" json:"lease_until"`
 		Origin           string    // 原文 TODO 原文查询
+		Deadline         time.Time `gorm:"-" json:"-"` // 作业截止时间, 配置了截止时间列时查询
+		Language         string    `gorm:"-" json:"-"` // 原文语言, 配置了语言列时查询
 	}
 	FindOriginResult struct {
-		QuestionId string `gorm:"column:question_id"`
-		Origin     string `gorm:"column:content"`
+		QuestionId string    `gorm:"column:question_id"`
+		Origin     string    `gorm:"column:content"`
+		Deadline   time.Time `gorm:"column:deadline"`
+		Language   string    `gorm:"column:language"`
 	}
 	AnswerMapper struct {
 		db *gorm.DB
@@ -51,6 +62,7 @@ const (
 	UnHandled = 1
 	Handling  = 2
 	Handled   = 3
+	Invalid   = 4
 )
 
 var (
@@ -60,6 +72,9 @@ var (
 	HandlingCond      = &Answer{AudioStatus: Handling}
 	HandledCond       = &Answer{AudioStatus: Handled}
 	NoOneFinished     = errors.New("没有记录被更新, 可能记录不存在或已完成")
+	MissingColumn     = errors.New("答案表缺少本服务维护的列, 请执行script/migrate.sql或配置DB.Migrate")
+	leaseColumns      = []string{"Owner", "LeaseUntil"} // 本服务在答案表中维护的列
+	LeaseLost         = errors.New("租约已失效, 记录已由其他实例处理")
 	Question2Homework = "table_elion_reading_homework_question"
 	Homework2Reading  = "table_elion_reading_homework"
 	Reading2Text      = "table_elion_reading"
@@ -74,17 +89,67 @@ func GetAnswerMapper() *AnswerMapper {
 		if err != nil {
 			panic(err)
 		}
+		if err = migrateAnswer(db, conf.DB.Migrate); err != nil {
+			panic(err)
+		}
 		answerMapper = &AnswerMapper{db: db}
 	})
 	return answerMapper
 }
 
-// ListUnHandledAnswers 获取未处理的答案
-func (m *AnswerMapper) ListUnHandledAnswers(ctx context.Context, size int) ([]*Answer, error) {
+// migrateAnswer 检查答案表中本服务维护的列, migrate为true时补充缺少的列
+// 答案表由其他服务维护, 不使用AutoMigrate, 只添加缺少的列, 不修改已有的列
+func migrateAnswer(db *gorm.DB, migrate bool) error {
+	migrator := db.Migrator()
+	for _, col := range leaseColumns {
+		if migrator.HasColumn(&Answer{}, col) {
+			continue
+		} else if !migrate {
+			return fmt.Errorf("%w: %s", MissingColumn, col)
+		}
+		logx.Infof("[answer mapper] add column %s", col)
+		if err := migrator.AddColumn(&Answer{}, col); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListUnHandledAnswers 获取未处理的答案, 并以owner的身份持有lease时长的租约
+// byDeadline为true时按作业截止时间获取, 没有截止时间的以提交时间代替, 与post.ByDeadline一致, 否则先处理提交早的
+func (m *AnswerMapper) ListUnHandledAnswers(ctx context.Context, owner string, size int, lease time.Duration, byDeadline bool) ([]*Answer, error) {
+	col := config.GetConfig().Priority.Deadline
+	return m.claim(ctx, owner, lease, func(tx *gorm.DB) *gorm.DB {
+		if byDeadline && col != "" { // 同一题目可能属于多个作业, 取最早的截止时间
+			deadline := fmt.Sprintf("(SELECT MIN(%[2]s.%[3]s) FROM %[1]s JOIN %[2]s ON %[1]s.homework_id = %[2]s.homework_id WHERE %[1]s.question_id = %[4]s.question_id)",
+				Question2Homework, Homework2Reading, col, Answer{}.TableName())
+			tx = tx.Order(fmt.Sprintf("COALESCE(%s, submitted_time) ASC", deadline))
+		}
+		return tx.Order("submitted_time ASC").Limit(size)
+	})
+}
+
+// CountUnHandledAnswers 统计可以获取的未处理记录数量, 与claim的条件一致
+func (m *AnswerMapper) CountUnHandledAnswers(ctx context.Context) (int64, error) {
+	var n int64
+	err := m.db.WithContext(ctx).Model(&Answer{}).Where(UnHandledCond).Where("audio IS NOT NULL AND audio != ''").Count(&n).Error
+	return n, err
+}
+
+// ClaimAnswers 获取指定id中未处理的答案, 并以owner的身份持有lease时长的租约
+// 已被其他实例获取或不是未处理状态的记录会被忽略
+func (m *AnswerMapper) ClaimAnswers(ctx context.Context, owner string, ids []int, lease time.Duration) ([]*Answer, error) {
+	return m.claim(ctx, owner, lease, func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("id IN ?", ids)
+	})
+}
+
+// claim 获取scope范围内未处理的答案, 标记为处理中并查询原文
+func (m *AnswerMapper) claim(ctx context.Context, owner string, lease time.Duration, scope func(tx *gorm.DB) *gorm.DB) ([]*Answer, error) {
 	var answers = make([]*Answer, 0)
 	err := m.db.Transaction(func(tx *gorm.DB) (err error) {
-		// 获取未处理的记录, 先处理提交早的
-		find := tx.WithContext(ctx).Where(UnHandledCond).Where("audio IS NOT NULL AND audio != ''").Order("submitted_time ASC").Limit(size).Find(&answers)
+		// 获取未处理的记录
+		find := scope(tx.WithContext(ctx).Where(UnHandledCond).Where("audio IS NOT NULL AND audio != ''")).Find(&answers)
 		if find.Error != nil && !errors.Is(find.Error, gorm.ErrRecordNotFound) { // 查询失败
 			return find.Error
 		} else if len(answers) == 0 { // 未查询到
@@ -97,10 +162,13 @@ func (m *AnswerMapper) ListUnHandledAnswers(ctx context.Context, size int) ([]*A
 			ids = append(ids, answer.ID)
 		}
 
-		// 将获取的记录都标记为处理中
+		// 将获取的记录都标记为处理中, 并记录租约
+		now := time.Now()
 		updates := tx.WithContext(ctx).Model(&Answer{}).Where("id IN ? AND audio_status = ?", ids, UnHandled).Updates(map[string]any{
 			"audio_status": Handling,
-			"handle_time":  time.Now(),
+			"handle_time":  now,
+			"owner":        owner,
+			"lease_until":  now.Add(lease),
 		})
 		if updates.Error != nil {
 			return updates.Error
@@ -118,8 +186,15 @@ func (m *AnswerMapper) ListUnHandledAnswers(ctx context.Context, size int) ([]*A
 		}
 		// 根据questions_id查询homework_id, 根据homework_id查询reference_reading_id, 根据reference_reading_id查询原文
 		var origins []FindOriginResult
+		fields := fmt.Sprintf("%s.question_id, %s.content", Question2Homework, Text2Origin)
+		if col := config.GetConfig().Priority.Deadline; col != "" { // 查询作业截止时间
+			fields += fmt.Sprintf(", %s.%s AS deadline", Homework2Reading, col)
+		}
+		if col := config.GetConfig().Comment.Language; col != "" { // 查询原文语言
+			fields += fmt.Sprintf(", %s.%s AS language", Text2Origin, col)
+		}
 		if err = tx.WithContext(ctx).Table(Question2Homework).
-			Select(fmt.Sprintf("%s.question_id, %s.content", Question2Homework, Text2Origin)).
+			Select(fields).
 			Joins(fmt.Sprintf("JOIN %s ON %s.homework_id = %s.homework_id", Homework2Reading, Question2Homework, Homework2Reading)).
 			Joins(fmt.Sprintf("JOIN %s ON %s.reference_reading_id = %s.reading_id", Reading2Text, Homework2Reading, Reading2Text)).
 			Joins(fmt.Sprintf("JOIN %s ON %s.text_id = %s.text_id", Text2Origin, Reading2Text, Text2Origin)).
@@ -127,61 +202,167 @@ func (m *AnswerMapper) ListUnHandledAnswers(ctx context.Context, size int) ([]*A
 			Scan(&origins).Error; err != nil {
 			return err
 		}
-		question2Origin := make(map[string]string)
+		question2Origin := make(map[string]FindOriginResult)
 		for _, origin := range origins {
-			question2Origin[origin.QuestionId] = origin.Origin
+			question2Origin[origin.QuestionId] = origin
 		}
 		for _, answer := range answers {
-			answer.Origin = question2Origin[answer.QuestionID]
+			answer.Origin = question2Origin[answer.QuestionID].Origin
+			answer.Deadline = question2Origin[answer.QuestionID].Deadline
+			answer.Language = question2Origin[answer.QuestionID].Language
 		}
 		return err
 	})
 	return answers, err
 }
 
-// FinishOne 将一个Handling的Answer标记为Handled
-func (m *AnswerMapper) FinishOne(ctx context.Context, id int, comment string) (success bool, err error) {
+// FinishOne 将一个Handling的Answer标记为Handled, 只有租约持有者可以完成
+// score不为空时同时记录分数, eval不为空时同时保存分析结果
+func (m *AnswerMapper) FinishOne(ctx context.Context, owner string, id int, comment string, score *int, eval *Evaluation) (success bool, err error) {
+	fields := map[string]any{}
+	if score != nil {
+		fields["score"] = *score
+	}
+	return m.complete(ctx, owner, id, Handled, comment, fields, func(tx *gorm.DB) error {
+		if eval != nil {
+			eval.RecordID = id
+			if err := saveEvaluation(tx, eval); err != nil {
+				return err
+			}
+		}
+		// 完成后清除失败记录
+		return tx.Where("record_id = ?", id).Delete(&Abandon{}).Error
+	})
+}
+
+// Invalidate 将一个录音无效的Handling的Answer标记为Invalid, 只有租约持有者可以完成
+// comment为展示给学生的评价, reason作为丢弃原因写入失败记录, 不会被重试
+func (m *AnswerMapper) Invalidate(ctx context.Context, owner string, id int, comment, reason string) (success bool, err error) {
+	return m.complete(ctx, owner, id, Invalid, comment, nil, func(tx *gorm.DB) error {
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "record_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"stage", "error", "state", "reason", "updated_at"}),
+		}).Create(&Abandon{RecordID: id, Stage: StageValidate, Error: reason, State: Discarded, Reason: "invalid recording"}).Error
+	})
+}
+
+// complete 将一个Handling的Answer标记为完成状态status并记录comment与fields中的字段, after在同一事务中执行
+func (m *AnswerMapper) complete(ctx context.Context, owner string, id, status int, comment string, fields map[string]any, after func(tx *gorm.DB) error) (success bool, err error) {
 	err = m.db.Transaction(func(tx *gorm.DB) (err error) {
 		var ans Answer
 		first := tx.WithContext(ctx).Model(&Answer{}).Where("id = ?", id).First(&ans)
 		if first.Error != nil { // TODO 上游处理not found
-			logx.Error("查询id:%d失败:%s", id, first.Error.Error())
-			return err
-		} else if ans.AudioStatus == Handled { // 已完成直接返回即可
+			logx.Errorf("查询id:%d失败:%s", id, first.Error.Error())
+			return first.Error
+		} else if ans.AudioStatus == Handled || ans.AudioStatus == Invalid { // 已完成直接返回即可
 			success = true
 			return nil
+		} else if ans.Owner != owner { // 租约已被其他实例获取
+			return LeaseLost
 		}
 
 		// 更新处理中的记录为已完成, 并记录comment
-		update := tx.Model(&Answer{}).Where("id = ? AND audio_status = ?", id, Handling).Updates(&Answer{
-			AudioStatus: Handled,
-			Comment:     comment,
-			HandleTime:  time.Now(),
-		})
+		updates := map[string]any{
+			"audio_status": status,
+			"comment":      comment,
+			"handle_time":  time.Now(),
+			"lease_until":  nil,
+		}
+		for k, v := range fields {
+			updates[k] = v
+		}
+		update := tx.Model(&Answer{}).Where("id = ? AND audio_status = ? AND owner = ?", id, Handling, owner).Updates(updates)
 		if update.Error != nil {
-			logx.Error("更新id:%d失败:err", id, update.Error.Error())
+			logx.Errorf("更新id:%d失败:%s", id, update.Error.Error())
 			return update.Error
 		} else if update.RowsAffected == 0 { // 更新失败, 可能是记录不存在或状态不是handling
 			return NoOneFinished
 		}
+		if err = after(tx.WithContext(ctx)); err != nil {
+			return err
+		}
 		success = true
 		return nil
 	})
 	return success, err
 }
 
-func (m *AnswerMapper) Reset(ctx context.Context, exclude []int) (err error) {
-	expire := time.Now().Add(time.Duration(config.GetConfig().Expire) * time.Second)
-	db := m.db.WithContext(ctx).Model(&Answer{}).
+// Reset 回收租约已过期的Handling记录, 重置为UnHandled, 已放弃的记录除外
+// 没有租约的记录(租约机制之前获取的)按handle_time判断是否过期
+func (m *AnswerMapper) Reset(ctx context.Context) (err error) {
+	now := time.Now()
+	expire := now.Add(-time.Duration(config.GetConfig().Expire) * time.Second)
+	result := m.db.WithContext(ctx).Model(&Answer{}).
 		Where("audio_status = ?", Handling).
-		Where("handle_time < ?", expire)
+		Where("lease_until < ? OR (lease_until IS NULL AND handle_time < ?)", now, expire).
+		Where("id NOT IN (?)", abandoned(m.db)).
+		Updates(unhandled(now))
+	return result.Error
+}
 
-	if len(exclude) > 0 {
-		db = db.Where("id NOT IN ?", exclude)
+// Renew 续约owner持有的一批记录, 返回仍由owner持有的记录id
+func (m *AnswerMapper) Renew(ctx context.Context, owner string, ids []int, lease time.Duration) ([]int, error) {
+	if err := m.db.WithContext(ctx).Model(&Answer{}).
+		Where("id IN ? AND audio_status = ? AND owner = ?", ids, Handling, owner).
+		Update("lease_until", time.Now().Add(lease)).Error; err != nil {
+		return nil, err
 	}
+	var held []int
+	err := m.db.WithContext(ctx).Model(&Answer{}).
+		Where("id IN ? AND audio_status = ? AND owner = ?", ids, Handling, owner).
+		Pluck("id", &held).Error
+	return held, err
+}
 
-	result := db.Updates(map[string]any{"audio_status": UnHandled, "handle_time": time.Now()})
-	return result.Error
+// Release 将owner持有的一批Handling记录重新标记为UnHandled, 用于退出时归还未完成的记录
+func (m *AnswerMapper) Release(ctx context.Context, owner string, ids []int) error {
+	return m.db.WithContext(ctx).Model(&Answer{}).
+		Where("id IN ? AND audio_status = ? AND owner = ?", ids, Handling, owner).
+		Updates(unhandled(time.Now())).Error
+}
+
+// Recomment 将已完成且存有当前录音识别结果的记录重新标记为未处理, 重新获取后只需生成评价, 返回更新的记录数
+// 录音重新上传后旧的识别结果不会命中, 这类记录不重置, 避免重新提交asr
+// 原文提示开关变化后识别结果同样不会命中, 这类记录重置后会重新提交asr
+func (m *AnswerMapper) Recomment(ctx context.Context, ids []int) (n int64, err error) {
+	err = m.db.Transaction(func(tx *gorm.DB) error {
+		var answers []*Answer
+		if err := tx.WithContext(ctx).Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "audio").
+			Where("id IN ? AND audio_status = ?", ids, Handled).Find(&answers).Error; err != nil {
+			return err
+		} else if len(answers) == 0 {
+			return nil
+		}
+		hashes := make(map[int]string, len(answers))
+		for _, ans := range answers {
+			hashes[ans.ID] = AudioHash(ans.Audio)
+		}
+		var transcripts []*Transcript
+		if err := tx.WithContext(ctx).Select("record_id", "audio_hash").
+			Where("record_id IN ?", ids).Find(&transcripts).Error; err != nil {
+			return err
+		}
+		matched := make([]int, 0, len(transcripts))
+		for _, t := range transcripts {
+			if hashes[t.RecordID] == t.AudioHash {
+				matched = append(matched, t.RecordID)
+			}
+		}
+		if len(matched) == 0 {
+			return nil
+		}
+		result := tx.WithContext(ctx).Model(&Answer{}).
+			Where("id IN ? AND audio_status = ?", matched, Handled).
+			Updates(unhandled(time.Now()))
+		n = result.RowsAffected
+		return result.Error
+	})
+	return n, err
+}
+
+// unhandled 重置为UnHandled时需要更新的字段, 同时释放租约
+func unhandled(now time.Time) map[string]any {
+	return map[string]any{"audio_status": UnHandled, "handle_time": now, "owner": "", "lease_until": nil}
 }
 
 func (a Answer) TableName() string {
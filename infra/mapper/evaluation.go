@@ -0,0 +1,75 @@
+package mapper
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sync"
+	"time"
+)
+
+// 对应数据库中 table_elion_reading_post_evaluation 表, 由本服务维护
+// 保存生成评价时的分析结果, 与评价在同一事务中写入
+// record_id 对应答案表的id
+// fluency 流利度指标的json
+// errors 与原文对齐得到的错误列表的json, 包括错误类型, 原文与朗读的内容及在原文中的偏移
+// template 生成评语的提示词模板, 名称@版本, 用于对比不同模板的效果
+// feedback 结构化评语的json, 展开的文本写入答案表的comment
+// score 评分各项的得分, 总分与等级的json, 总分同时写入答案表的score
+
+type (
+	Evaluation struct {
+		ID        int       `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+		RecordID  int       `gorm:"column:record_id;uniqueIndex" json:"record_id"`
+		Fluency   string    `gorm:"column:fluency;type:text" json:"fluency"`
+		Errors    string    `gorm:"column:errors;type:text" json:"errors"`
+		Score     string    `gorm:"column:score;type:text" json:"score"`
+		Template  string    `gorm:"column:template;size:64;index" json:"template"`
+		Feedback  string    `gorm:"column:feedback;type:text" json:"feedback"`
+		CreatedAt time.Time `gorm:"column:created_at" json:"created_at"`
+		UpdatedAt time.Time `gorm:"column:updated_at" json:"updated_at"`
+	}
+	EvaluationMapper struct {
+		db *gorm.DB
+	}
+)
+
+var (
+	evaluationMapper *EvaluationMapper
+	evaluationOnce   sync.Once
+)
+
+// GetEvaluationMapper 获取EvaluationMapper单例, 与AnswerMapper共用连接
+func GetEvaluationMapper() *EvaluationMapper {
+	evaluationOnce.Do(func() {
+		db := GetAnswerMapper().db
+		if err := db.AutoMigrate(&Evaluation{}); err != nil {
+			panic(err)
+		}
+		evaluationMapper = &EvaluationMapper{db: db}
+	})
+	return evaluationMapper
+}
+
+// Find 查询记录的分析结果, 不存在时返回nil
+func (m *EvaluationMapper) Find(ctx context.Context, id int) (*Evaluation, error) {
+	var e Evaluation
+	err := m.db.WithContext(ctx).Where("record_id = ?", id).Take(&e).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &e, err
+}
+
+// saveEvaluation 在事务中保存分析结果, 已存在时覆盖
+func saveEvaluation(tx *gorm.DB, e *Evaluation) error {
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "record_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"fluency", "errors", "score", "template", "feedback", "updated_at"}),
+	}).Create(e).Error
+}
+
+func (e Evaluation) TableName() string {
+	return "table_elion_reading_post_evaluation"
+}
@@ -0,0 +1,81 @@
+package mapper
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sync"
+	"time"
+)
+
+// 对应数据库中 table_elion_reading_post_asr 表, 由本服务维护
+// 持久化asr识别结果, 避免重启或其他实例获取记录后重复识别
+// record_id 对应答案表的id
+// audio_hash 录音地址的sha256, 录音重新上传后不会命中旧的结果
+// biased 识别时是否使用了原文提示, 用于对比有无提示的准确率, 提示开关变化后旧的结果不会命中, 重新识别后覆盖
+// raw asr服务返回的原始json
+
+type (
+	Transcript struct {
+		ID           int       `gorm:"column:id;primaryKey;autoIncrement" json:"id"`
+		RecordID     int       `gorm:"column:record_id;uniqueIndex:idx_record_audio" json:"record_id"`
+		AudioHash    string    `gorm:"column:audio_hash;size:64;uniqueIndex:idx_record_audio" json:"audio_hash"`
+		Provider     string    `gorm:"column:provider;size:32" json:"provider"`
+		Biased       bool      `gorm:"column:biased" json:"biased"`
+		ModelVersion string    `gorm:"column:model_version;size:64" json:"model_version"`
+		Raw          string    `gorm:"column:raw;type:mediumtext" json:"raw"`
+		CreatedAt    time.Time `gorm:"column:created_at" json:"created_at"`
+		UpdatedAt    time.Time `gorm:"column:updated_at" json:"updated_at"`
+	}
+	TranscriptMapper struct {
+		db *gorm.DB
+	}
+)
+
+var (
+	transcriptMapper *TranscriptMapper
+	transcriptOnce   sync.Once
+)
+
+// GetTranscriptMapper 获取TranscriptMapper单例, 与AnswerMapper共用连接
+func GetTranscriptMapper() *TranscriptMapper {
+	transcriptOnce.Do(func() {
+		db := GetAnswerMapper().db
+		if err := db.AutoMigrate(&Transcript{}); err != nil {
+			panic(err)
+		}
+		transcriptMapper = &TranscriptMapper{db: db}
+	})
+	return transcriptMapper
+}
+
+// AudioHash 计算录音地址的hash
+func AudioHash(audio string) string {
+	sum := sha256.Sum256([]byte(audio))
+	return hex.EncodeToString(sum[:])
+}
+
+// Find 查询记录对应录音在给定提示开关下的识别结果, 不存在时返回nil
+func (m *TranscriptMapper) Find(ctx context.Context, id int, audio string, biased bool) (*Transcript, error) {
+	var t Transcript
+	err := m.db.WithContext(ctx).Where("record_id = ? AND audio_hash = ? AND biased = ?", id, AudioHash(audio), biased).Take(&t).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &t, err
+}
+
+// Save 保存识别结果, 已存在时覆盖
+func (m *TranscriptMapper) Save(ctx context.Context, t *Transcript) error {
+	return m.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "record_id"}, {Name: "audio_hash"}},
+		DoUpdates: clause.AssignmentColumns([]string{"provider", "biased", "model_version", "raw", "updated_at"}),
+	}).Create(t).Error
+}
+
+func (t Transcript) TableName() string {
+	return "table_elion_reading_post_asr"
+}
@@ -3,7 +3,10 @@
 package main
 
 import (
+	"context"
 	"github.com/cloudwego/hertz/pkg/app/server"
+	hconfig "github.com/cloudwego/hertz/pkg/common/config"
+	"github.com/zeromicro/go-zero/core/logx"
 	"gitlab.aiecnu.net/elion/elion-reading-post/infra/config"
 	"gitlab.aiecnu.net/elion/elion-reading-post/post"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
@@ -11,6 +14,7 @@ import (
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/propagation"
 	"net/http"
+	"time"
 )
 
 func Init() {
@@ -21,9 +25,19 @@ func Init() {
 
 func main() {
 	Init()
-	post.GetManager(config.GetConfig().Consumers).Run()
+	m := post.GetManager(config.GetConfig().Consumers)
+	m.Run(context.Background())
 
-	h := server.Default()
+	var opts []hconfig.Option
+	if wait := config.GetConfig().ExitWait; wait > 0 { // 等待处理中的任务完成
+		opts = append(opts, server.WithExitWaitTime(time.Duration(wait)*time.Second))
+	}
+	h := server.Default(opts...)
+	h.OnShutdown = append(h.OnShutdown, func(ctx context.Context) {
+		if err := m.Shutdown(ctx); err != nil {
+			logx.Errorf("[main] shutdown manager err: %v", err)
+		}
+	})
 	register(h)
 	h.Spin()
 }
@@ -0,0 +1,148 @@
+package post
+
+import (
+	"context"
+	"github.com/zeromicro/go-zero/core/logx"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/config"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/mapper"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	ewmaWeight = 0.2 // 阶段耗时滑动平均的权重
+)
+
+type (
+	// stats 统计各阶段的耗时与错误, 供自动扩缩容使用
+	stats struct {
+		mu      sync.Mutex
+		latency map[string]time.Duration // 各阶段耗时的滑动平均
+		total   map[string]int           // 统计周期内各阶段的执行次数
+		failed  map[string]int           // 统计周期内各阶段的失败次数
+	}
+	// Autoscaler 根据积压, 阶段耗时与上游错误率自动调整各阶段的消费者数量
+	Autoscaler struct {
+		m          *Manager
+		min, max   int
+		interval   time.Duration
+		drain      time.Duration
+		maxErrRate float64
+	}
+)
+
+func newStats() *stats {
+	return &stats{latency: make(map[string]time.Duration), total: make(map[string]int), failed: make(map[string]int)}
+}
+
+// observe 记录一次阶段执行
+func (s *stats) observe(stage string, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if last, ok := s.latency[stage]; ok {
+		s.latency[stage] = time.Duration(ewmaWeight*float64(d) + (1-ewmaWeight)*float64(last))
+	} else {
+		s.latency[stage] = d
+	}
+	s.total[stage]++
+	if err != nil {
+		s.failed[stage]++
+	}
+}
+
+// snapshot 返回阶段处理一个任务的平均耗时与上游(asr与comment)步骤的错误率, 并开始新的统计周期
+func (s *stats) snapshot(stage *Stage) (latency time.Duration, errRate float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total, failed int
+	for _, st := range stage.steps {
+		latency += s.latency[st.name]
+		if st.name == mapper.StageASR || st.name == mapper.StageComment {
+			total, failed = total+s.total[st.name], failed+s.failed[st.name]
+		}
+		delete(s.total, st.name)
+		delete(s.failed, st.name)
+	}
+	if total > 0 {
+		errRate = float64(failed) / float64(total)
+	}
+	return latency, errRate
+}
+
+// NewAutoscaler 根据配置创建自动扩缩容
+func NewAutoscaler(m *Manager) *Autoscaler {
+	conf := config.GetConfig().Autoscale
+	return &Autoscaler{
+		m:          m,
+		min:        max(conf.Min, 1),
+		max:        max(conf.Max, conf.Min, 1),
+		interval:   time.Duration(conf.Interval) * time.Second,
+		drain:      time.Duration(conf.Drain) * time.Second,
+		maxErrRate: conf.MaxErrRate,
+	}
+}
+
+// Run 定期调整消费者数量, ctx取消后退出
+func (a *Autoscaler) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		pending := a.pending(ctx)
+		for _, s := range a.m.stages {
+			a.scale(s, pending)
+		}
+	}
+}
+
+// pending 第一个阶段的积压, 包括idle中的任务与数据库中可以获取的未处理记录
+// idle最多只有一个batch, 不能反映真实的积压; 统计失败时只使用idle
+func (a *Autoscaler) pending(ctx context.Context) int {
+	idle := a.m.Status().Idle
+	n, err := a.m.mapper.CountUnHandledAnswers(ctx)
+	if err != nil {
+		logx.Errorf("[autoscaler] count unhandled err: %v", err)
+		return idle
+	}
+	return idle + int(n)
+}
+
+// scale 调整一个阶段的消费者数量, 第一个阶段的积压为pending, 其余阶段为输入队列中的任务
+func (a *Autoscaler) scale(s *Stage, pending int) {
+	status := s.Status()
+	backlog := status.Queue
+	if s.first {
+		backlog = pending
+	}
+	latency, errRate := a.m.stats.snapshot(s)
+	if n := a.desired(status, backlog, latency, errRate, s.blocked()); n != status.Size {
+		logx.Infof("[autoscaler] %s backlog: %d, busy: %d, latency: %s, error rate: %.2f, resize to %d",
+			s.Name, backlog, status.Busy, latency, errRate, n)
+		s.Resize(n)
+	}
+}
+
+// desired 计算期望的消费者数量
+// 上游错误率过高时缩容以减轻上游压力; 下游队列已满时扩容无意义, 保持不变;
+// 存在积压时按平均耗时估算在drain内清空积压所需的数量; 无积压时逐步回收空闲的消费者
+func (a *Autoscaler) desired(status StageStatus, backlog int, latency time.Duration, errRate float64, blocked bool) int {
+	var n int
+	switch {
+	case errRate > a.maxErrRate:
+		n = status.Size - max(status.Size/4, 1)
+	case blocked:
+		n = status.Size
+	case backlog > 0 && latency > 0:
+		n = status.Busy + int(math.Ceil(float64(backlog)*float64(latency)/float64(a.drain)))
+	case backlog > 0: // 尚无耗时统计, 按积压数量扩容
+		n = status.Size + backlog
+	default:
+		n = status.Size - (status.Size-status.Busy+1)/2
+	}
+	return min(max(n, a.min), a.max)
+}
@@ -0,0 +1,53 @@
+package post
+
+import (
+	"errors"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/mapper"
+	"testing"
+	"time"
+)
+
+func TestAutoscalerDesired(t *testing.T) {
+	a := &Autoscaler{min: 1, max: 8, drain: time.Minute, maxErrRate: 0.5}
+	cases := []struct {
+		name    string
+		status  StageStatus
+		backlog int
+		latency time.Duration
+		errRate float64
+		blocked bool
+		want    int
+	}{
+		{"scale up under backlog", StageStatus{Size: 2, Busy: 2}, 6, 20 * time.Second, 0, false, 4},
+		{"scale up without latency", StageStatus{Size: 2, Busy: 2}, 3, 0, 0, false, 5},
+		{"clamp to max", StageStatus{Size: 4, Busy: 4}, 100, 30 * time.Second, 0, false, 8},
+		{"scale down when idle", StageStatus{Size: 6, Busy: 2}, 0, time.Second, 0, false, 4},
+		{"clamp to min", StageStatus{Size: 1}, 0, 0, 0, false, 1},
+		{"keep when downstream is blocked", StageStatus{Size: 3, Busy: 3}, 50, 10 * time.Second, 0, true, 3},
+		{"scale down on upstream errors", StageStatus{Size: 8, Busy: 8}, 50, 10 * time.Second, 0.8, false, 6},
+	}
+	for _, c := range cases {
+		if n := a.desired(c.status, c.backlog, c.latency, c.errRate, c.blocked); n != c.want {
+			t.Fatalf("%s: expected %d, got %d", c.name, c.want, n)
+		}
+	}
+}
+
+func TestStatsSnapshot(t *testing.T) {
+	s := newStats()
+	stage := &Stage{steps: []step{{name: mapper.StageValidate}, {name: mapper.StageASR}}}
+	s.observe(mapper.StageValidate, 100*time.Millisecond, nil)
+	s.observe(mapper.StageASR, time.Second, nil)
+	s.observe(mapper.StageASR, 2*time.Second, errors.New("timeout"))
+	s.observe(mapper.StageValidate, 600*time.Millisecond, errors.New("invalid")) // 校验失败不计入上游错误率
+
+	// 滑动平均: validate 0.2*600+0.8*100=200ms, asr 0.2*2000+0.8*1000=1200ms
+	latency, errRate := s.snapshot(stage)
+	if latency != 1400*time.Millisecond || errRate != 0.5 {
+		t.Fatalf("unexpected latency %s, error rate %.2f", latency, errRate)
+	}
+	// 新的统计周期中错误率重新计算, 耗时的滑动平均保留
+	if latency, errRate = s.snapshot(stage); latency != 1400*time.Millisecond || errRate != 0 {
+		t.Fatalf("unexpected latency %s, error rate %.2f after snapshot", latency, errRate)
+	}
+}
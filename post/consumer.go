@@ -1,103 +1,209 @@
 package post
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/zeromicro/go-zero/core/logx"
 	"gitlab.aiecnu.net/elion/elion-reading-post/infra/call"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/config"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/mapper"
+	"slices"
+	"strconv"
 	"time"
 )
 
-var (
-	format  = "mp3"
-	codec   = "opus"
-	rate    = 16000
-	bits    = 16
-	channel = 1
-)
-
 type (
+	// Consumer 消费者, 属于流水线中的一个阶段, 负责执行该阶段的步骤
 	Consumer struct {
 		Manager *Manager
-		Entry   *Entry
-		ASRResp *call.ASRTaskResp // ASR结果
-		Comment string            // 最终评价
+		Stage   *Stage
+		retire  context.CancelFunc // 停止获取新任务
 	}
 )
 
-func NewConsumer(m *Manager) *Consumer {
-	return &Consumer{Manager: m}
+var (
+	asrSteps     = []step{{mapper.StageValidate, (*Consumer).validate}, {mapper.StageASR, (*Consumer).asr}}
+	commentSteps = []step{{mapper.StageComment, (*Consumer).comment}, {mapper.StageScore, (*Consumer).score}, {mapper.StageFinish, (*Consumer).finish}}
+)
+
+func NewConsumer(m *Manager, s *Stage) *Consumer {
+	return &Consumer{Manager: m, Stage: s}
 }
 
-// Consume 开始消费
-func (c *Consumer) Consume() {
-	go c.consume()
+// Consume 开始消费, ctx取消后处理完当前任务即退出
+func (c *Consumer) Consume(ctx context.Context) {
+	ctx, c.retire = context.WithCancel(ctx)
+	go c.consume(ctx)
+}
+
+// Retire 退休, 处理完当前任务后退出
+func (c *Consumer) Retire() {
+	if c.retire != nil {
+		c.retire()
+	}
 }
 
 // consume 实际消费逻辑
-func (c *Consumer) consume() {
+func (c *Consumer) consume(ctx context.Context) {
+	defer c.Stage.wg.Done()
 	for {
-		// 请求新的
-		c.Entry = c.Manager.RequestOne()
-		// asr识别 与 生成评价, 一个失败就会放弃任务
-		if !(c.asr() && c.comment() && c.finish()) {
-			c.Manager.Abandon(c.Entry.ID) // TODO 放弃任务
+		// 请求新的, 返回nil说明已经停止消费
+		en := c.Stage.take(ctx)
+		if en == nil {
+			return
+		}
+		// 执行阶段中的步骤, 一个失败就会放弃任务, 成功则交给下一个阶段
+		if c.Stage.handle(c, en) {
+			c.Stage.forward(en)
 		}
 	}
 }
 
+// validate 提交asr之前校验录音, 无效的录音直接完成, 不支持的格式直接放弃
+func (c *Consumer) validate(en *Entry) error {
+	if v, ok := c.Manager.LoadASR(en.Context(), en); ok { // 先前处理过asr, 无需校验
+		logx.Infof("[consumer] asr hit stored result %d", en.ID)
+		en.ASRResp = v
+		return nil
+	}
+
+	check := call.GetAudioCheck()
+	f, err := check.InspectAudio(en.Context(), en.Answer.Audio, en.Answer.AudioContentType)
+	if err != nil {
+		logx.Errorf("[consumer] inspect audio %d err:%s", en.ID, err)
+		return err
+	}
+	if err = check.Validate(f, time.Duration(en.Answer.AudioTime)*time.Second); err != nil {
+		logx.Infof("[consumer] invalid audio %d: %s", en.ID, err)
+		return err
+	} else if !call.GetRecognizer().Supports(&f.AudioFormat) {
+		return fmt.Errorf("%w: %s/%s", call.UnsupportedAudio, f.Format, f.Codec)
+	}
+	en.Audio = f
+	return nil
+}
+
 // asr 识别文件
-func (c *Consumer) asr() bool {
-	if v, ok := c.Manager.QueryASR(c.Entry.ID); ok { // 先前处理过asr
-		logx.Info("[consumer] asr hit cache %d", c.Entry.ID)
-		c.ASRResp = v
-		return true
+func (c *Consumer) asr(en *Entry) error {
+	if en.ASRResp != nil { // 校验时已加载持久化的结果
+		return nil
 	}
 
 	var err error
-	var ok bool
-	task := call.NewFileAsrTask(c.uid(), c.Entry.Answer.Audio, format, codec, rate, bits, channel)
-	if ok, err = task.Submit(); err != nil || !ok { // 提交失败
-		logx.Error("[consumer] asr submit err:%s", err)
-		return ok
-	}
-	if c.ASRResp, err = task.Query(); err != nil { // 查询失败
-		logx.Error("[consumer] asr query err:%s", err)
-		return false
+	task := call.NewFileAsrTaskWithFormat(uid(en), en.Answer.Audio, &en.Audio.AudioFormat)
+	if biased(en) {
+		task.Origin = en.Answer.Origin
+	}
+	if en.ASRResp, err = call.GetRecognizer().Recognize(en.Context(), task); err != nil { // 识别失败
+		logx.Errorf("[consumer] asr recognize err:%s", err)
+		return err
 	}
 
-	// 缓存结果
-	c.Manager.CacheASR(c.Entry.ID, c.ASRResp)
-	return true
+	// 持久化结果
+	c.Manager.SaveASR(en.Context(), en, en.ASRResp)
+	return nil
 }
 
 // comment 生成评语
-func (c *Consumer) comment() bool {
-	if v, ok := c.Manager.QueryCache(c.Entry.ID); ok {
-		logx.Info("[consumer] comment hit cache %d", c.Entry.ID)
-		c.Comment = v
-		return true
+func (c *Consumer) comment(en *Entry) error {
+	lang := call.Language(en.Answer.Language, en.Answer.Origin)
+	en.Comparison = call.Compare(en.Answer.Origin, en.ASRResp.Result.Text, lang, config.GetConfig().Comment.Pinyin)
+	en.Fluency = call.AnalyzeFluency(en.ASRResp, lang)
+	tpl := call.GetTemplates().Pick(lang, assignment(en)) // 分配是确定的, 命中缓存时与生成时相同
+	if tpl == nil {
+		return call.NoTemplate
+	}
+	en.Template = tpl.ID()
+	if v, ok := c.Manager.QueryCache(en.ID); ok {
+		logx.Infof("[consumer] comment hit cache %d", en.ID)
+		en.Feedback = v
+		return nil
 	}
 
 	var err error
-	var ok bool
-	task := call.NewCommentTask(c.Entry.ID, c.Entry.Answer.Origin, c.ASRResp.Result.Text)
-	if ok, err = task.Submit(); err != nil || !ok {
-		logx.Error("[consumer] comment submit err:%s", err)
-		return ok
-	}
-	if c.Comment, err = task.Query(); err != nil {
-		logx.Error("[consumer] comment query err:%s", err)
-		return false
+	task := call.NewCommentTask(en.ID, en.Answer.Origin, en.ASRResp.Result.Text).WithLanguage(lang).
+		WithComparison(en.Comparison).WithFluency(en.Fluency).WithTemplate(tpl)
+	if _, err = task.Submit(en.Context()); err != nil {
+		logx.Errorf("[consumer] comment submit err:%s", err)
+		return err
 	}
-	return true
+	if en.Feedback, err = task.Query(); err != nil {
+		logx.Errorf("[consumer] comment query err:%s", err)
+		return err
+	}
+	return nil
+}
+
+// score 按评分细则打分, 表现力评分失败时不计入总分
+func (c *Consumer) score(en *Entry) error {
+	rubric := call.GetRubric()
+	var expressiveness *float64
+	if rubric.Expressive() && en.Comparison != nil && en.Comparison.OriginLen > 0 {
+		if v, err := call.Express(en.Context(), en.Answer.Origin, en.ASRResp.Result.Text, en.Comparison, en.Fluency); err != nil {
+			logx.Errorf("[consumer] express %d err:%s", en.ID, err)
+		} else {
+			expressiveness = &v
+		}
+	}
+	en.Score = rubric.Rate(en.Comparison, en.Fluency, expressiveness)
+	return nil
 }
 
 // finish 标记任务完成
-func (c *Consumer) finish() bool {
-	finished, err := c.Manager.FinishOne(c.Entry.ID, c.Comment)
-	return err == nil && finished
+func (c *Consumer) finish(en *Entry) error {
+	var score *int
+	if en.Score != nil {
+		score = &en.Score.Total
+	}
+	finished, err := c.Manager.FinishOne(en.Context(), en.ID, en.Feedback, score, evaluation(en))
+	if err != nil {
+		return err
+	} else if !finished {
+		return mapper.NoOneFinished
+	}
+	return nil
+}
+
+// evaluation 生成评价时的分析结果
+func evaluation(en *Entry) *mapper.Evaluation {
+	eval := &mapper.Evaluation{Template: en.Template}
+	if en.Fluency != nil {
+		b, _ := json.Marshal(en.Fluency)
+		eval.Fluency = string(b)
+	}
+	if en.Comparison != nil {
+		b, _ := json.Marshal(en.Comparison.Errors())
+		eval.Errors = string(b)
+	}
+	if en.Score != nil {
+		b, _ := json.Marshal(en.Score)
+		eval.Score = string(b)
+	}
+	if en.Feedback != nil {
+		b, _ := json.Marshal(en.Feedback)
+		eval.Feedback = string(b)
+	}
+	return eval
+}
+
+// biased 是否使用原文提示asr, 由配置按题目开关
+func biased(en *Entry) bool {
+	conf := config.GetConfig().ASR.Bias
+	if !conf.Enable || en.Answer.Origin == "" || slices.Contains(conf.Exclude, en.Answer.QuestionID) {
+		return false
+	}
+	return len(conf.Include) == 0 || slices.Contains(conf.Include, en.Answer.QuestionID)
+}
+
+// assignment 分配提示词模板的key, 由配置决定按学生还是按答案分配
+func assignment(en *Entry) string {
+	if config.GetConfig().Comment.Assign == "answer" {
+		return strconv.Itoa(en.ID)
+	}
+	return en.Answer.StudentID
 }
 
-func (c *Consumer) uid() string {
-	return fmt.Sprintf("%s-%d", time.Now().Format("20060102-150405"), c.Entry.ID)
+func uid(en *Entry) string {
+	return fmt.Sprintf("%s-%d", time.Now().Format("20060102-150405"), en.ID)
 }
@@ -1,38 +1,93 @@
 package post
 
 import (
+	"cmp"
+	"context"
 	"errors"
+	"fmt"
 	"github.com/avast/retry-go"
 	"github.com/zeromicro/go-zero/core/logx"
 	"gitlab.aiecnu.net/elion/elion-reading-post/infra/call"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/config"
 	"gitlab.aiecnu.net/elion/elion-reading-post/infra/mapper"
-	"golang.org/x/net/context"
 	"golang.org/x/sync/singleflight"
+	"os"
 	"sync"
 	"time"
 )
 
 type (
 	ConsumeState string // 消费状态
-	// Manager 管理 Consumer的创建与销毁 TODO 多次失败的任务
+	// Manager 管理任务的生命周期与流水线中各阶段的消费者
 	Manager struct {
-		mu          sync.Mutex                // 维护manager状态
-		mapper      *mapper.AnswerMapper      // 数据库mapper
-		resetTicker *time.Ticker              // 重置计时器
-		cap         int                       // 消费者数量
-		consumers   []*Consumer               // 消费者
-		idle        map[int]*Entry            // idle的Entry
-		consuming   map[int]*Entry            // 消费中的Entry
-		abandon     map[int]*Entry            // 放弃的Entry
-		cache       map[int]string            // 缓存id对应的comment
-		asr         map[int]*call.ASRTaskResp // 缓存id对应的asr结果
+		mu          sync.Mutex               // 维护manager状态
+		mapper      answerStore              // 数据库mapper
+		abandoned   abandonStore             // 失败记录mapper
+		transcripts *mapper.TranscriptMapper // asr结果mapper
+		evaluations *mapper.EvaluationMapper // 分析结果mapper, 写入由mapper在完成任务的事务中进行
+		resetTicker *time.Ticker             // 重置计时器
+		stages      []*Stage                 // 流水线中的阶段, 按处理顺序排列
+		idle        *idleQueue               // idle的Entry, 按优先级排序
+		consuming   map[int]*Entry           // 消费中的Entry
+		abandon     map[int]*Entry           // 放弃的Entry
+		cache       map[int]*call.Feedback   // 缓存id对应的评语
 		sf          singleflight.Group
+		wake        chan struct{}      // 唤醒等待中的fetch
+		cancel      context.CancelFunc // 停止消费者与定时任务
+		owner       string             // 实例id, 作为租约的持有者
+		lease       time.Duration      // 租约时长
+		stopRenew   context.CancelFunc // 停止续约, 在归还记录后调用
+		work        context.Context    // 各任务ctx的父ctx
+		abort       context.CancelFunc // 取消仍在处理中的任务, 在归还记录前调用
+		stats       *stats             // 各阶段的耗时与错误统计
+		byDeadline  bool               // 是否按截止时间获取, 与idle中的优先级一致
+		autoscale   bool               // 是否启用自动扩缩容
+	}
+	// answerStore 答案表的操作, 由mapper.AnswerMapper实现
+	answerStore interface {
+		ListUnHandledAnswers(ctx context.Context, owner string, size int, lease time.Duration, byDeadline bool) ([]*mapper.Answer, error)
+		ClaimAnswers(ctx context.Context, owner string, ids []int, lease time.Duration) ([]*mapper.Answer, error)
+		CountUnHandledAnswers(ctx context.Context) (int64, error)
+		FinishOne(ctx context.Context, owner string, id int, comment string, score *int, eval *mapper.Evaluation) (bool, error)
+		Invalidate(ctx context.Context, owner string, id int, comment, reason string) (bool, error)
+		Reset(ctx context.Context) error
+		Renew(ctx context.Context, owner string, ids []int, lease time.Duration) ([]int, error)
+		Release(ctx context.Context, owner string, ids []int) error
+		Recomment(ctx context.Context, ids []int) (int64, error)
+	}
+	// abandonStore 放弃表的操作, 由mapper.AbandonMapper实现
+	abandonStore interface {
+		Record(ctx context.Context, id int, stage, reason string, times int, abandoned bool) error
+		Times(ctx context.Context, ids []int) (map[int]int, error)
+		Unabandon(ctx context.Context, id int) (bool, error)
+		Retry(ctx context.Context, filter *mapper.DeadLetterFilter) ([]int, error)
+		Discard(ctx context.Context, ids []int, reason string) (int64, error)
+	}
+	// PoolStatus 消费者池的状态
+	PoolStatus struct {
+		Idle      int           `json:"idle"`      // 积压的任务数
+		Consuming int           `json:"consuming"` // 处理中的任务数
+		Abandon   int           `json:"abandon"`   // 放弃的任务数
+		Stages    []StageStatus `json:"stages"`    // 各阶段的状态
 	}
 	Entry struct {
-		ID           int            // 记录ID
-		State        ConsumeState   // 记录状态
-		Answer       *mapper.Answer // 记录信息
-		AbandonTimes int            // 放弃次数
+		ID           int               // 记录ID
+		State        ConsumeState      // 记录状态
+		Answer       *mapper.Answer    // 记录信息
+		AbandonTimes int               // 放弃次数
+		Urgent       bool              // 是否加急
+		Audio        *call.AudioFile   // 录音信息, 校验时获取
+		ASRResp      *call.ASRTaskResp // ASR结果
+		Fluency      *call.Fluency     // 流利度
+		Comparison   *call.Comparison  // 与原文的比较结果
+		Score        *call.Score       // 评分, 没有原文时为空
+		Template     string            // 评语使用的提示词模板, 名称@版本
+		Feedback     *call.Feedback    // 最终评价
+		ctx          context.Context   // 处理任务的ctx, 租约丢失或退出时取消
+		cancel       context.CancelFunc
+		enqueued     time.Time // 首次进入idle的时间, 用于老化
+		key          float64   // 优先队列的排序键
+		pos          int       // 在优先队列中的位置
 	}
 )
 
@@ -42,89 +97,266 @@ var (
 	Finished      ConsumeState = "finished"                 // 已完成
 	Abandoned     ConsumeState = "abandoned"                // 放弃
 	NeedToWait                 = errors.New("暂时无新记录, 需要等待") // 标识等待的异常
+	NoSuchStage                = errors.New("不存在的阶段")       // 阶段名称错误
+	InvalidSize                = errors.New("消费者数量至少为1")    // 阶段没有消费者时任务会一直积压
 	batch                      = 10                         // 一次取出的个数
 	resetInterval              = 180                        // reset间隔
 	fetchInterval              = 60                         // fetch间隔
 	maxAbandon                 = 5                          // 最多放弃五次
+	releaseWait                = 10 * time.Second           // 退出时归还记录的超时时间
+	defaultLease               = 300 * time.Second          // 默认租约时长
 	opts                       = []retry.Option{            // 重试策略
 		retry.Attempts(uint(5)),             // 最大重试次数
 		retry.DelayType(retry.BackOffDelay), // 指数退避策略
 		retry.MaxDelay(64 * time.Second),    // 最大退避间隔
 		retry.OnRetry(func(n uint, err error) { // 重试日志
-			logx.Info("[manager] retry #%d times with err:%v", n+1, err)
+			logx.Infof("[manager] retry #%d times with err:%v", n+1, err)
 		}),
 		retry.RetryIf(func(err error) bool {
 			return !errors.Is(err, NeedToWait) // 当error不为NeedToWait时才需要重试
 		}),
+		retry.LastErrorOnly(true), // 只返回最后一次的错误, 以便判断NeedToWait
 	}
 	once    sync.Once
 	manager *Manager
 )
 
-// GetManager 创建管理者
+// GetManager 创建管理者, cap为未单独配置数量的阶段的消费者数量
 func GetManager(cap int) *Manager {
 	once.Do(func() {
-		m := &Manager{mu: sync.Mutex{}, cap: cap, mapper: mapper.GetAnswerMapper(),
-			resetTicker: time.NewTicker(time.Duration(resetInterval) * time.Second),
-			idle:        make(map[int]*Entry),
-			consuming:   make(map[int]*Entry),
-			abandon:     make(map[int]*Entry),
-			cache:       make(map[int]string),
-			asr:         make(map[int]*call.ASRTaskResp),
+		conf := config.GetConfig()
+		lease := time.Duration(conf.Expire) * time.Second
+		if lease <= 0 {
+			lease = defaultLease
 		}
-		for range cap {
-			m.consumers = append(m.consumers, NewConsumer(m))
-		}
-		m.resetTicker = time.NewTicker(time.Duration(resetInterval) * time.Second)
+		m := newManager(mapper.GetAnswerMapper(), mapper.GetAbandonMapper(), instance(), lease,
+			newIdleQueue(conf.Priority.Func, conf.Priority.Aging, conf.Priority.Urgent))
+		m.transcripts, m.evaluations = mapper.GetTranscriptMapper(), mapper.GetEvaluationMapper()
+		m.byDeadline, m.autoscale = conf.Priority.Func == "deadline", conf.Autoscale.Enable
+		asr := newStage(m, mapper.StageASR, cmp.Or(conf.Pipeline.ASR, cap), 0, true, asrSteps...)
+		comment := newStage(m, mapper.StageComment, cmp.Or(conf.Pipeline.Comment, cap), conf.Pipeline.Queue, false, commentSteps...)
+		asr.next = comment
+		m.stages = []*Stage{asr, comment}
 		manager = m
 	})
 	return manager
 }
 
-// Run 启动所有的消费者
-func (m *Manager) Run() {
-	for _, c := range m.consumers {
-		c.Consume()
+// newManager 创建管理者, 不包括流水线中的阶段
+func newManager(answers answerStore, abandoned abandonStore, owner string, lease time.Duration, idle *idleQueue) *Manager {
+	m := &Manager{mapper: answers, abandoned: abandoned,
+		resetTicker: time.NewTicker(time.Duration(resetInterval) * time.Second),
+		idle:        idle,
+		consuming:   make(map[int]*Entry),
+		abandon:     make(map[int]*Entry),
+		cache:       make(map[int]*call.Feedback),
+		wake:        make(chan struct{}, 1),
+		stats:       newStats(),
+		owner:       owner,
+		lease:       lease,
 	}
-	go manager.Reset()
+	m.work, m.abort = context.WithCancel(context.Background())
+	return m
 }
 
-// Reset 定期重置无效的数据
-func (m *Manager) Reset() {
-	for range m.resetTicker.C {
-		m.mu.Lock()
-		var exclude []int
-		if len(m.abandon) > 0 {
-			for id := range m.abandon {
-				exclude = append(exclude, id)
-			}
+// instance 当前实例的id, 未配置时使用主机名与进程号
+func instance() string {
+	if id := config.GetConfig().Instance; id != "" {
+		return id
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// Run 启动所有阶段的消费者, ctx取消后不再获取新的任务
+func (m *Manager) Run(ctx context.Context) {
+	// 续约需要持续到处理中的任务归还之后, 使用独立的ctx
+	var renew context.Context
+	renew, m.stopRenew = context.WithCancel(ctx)
+	ctx, m.cancel = context.WithCancel(ctx)
+	for _, s := range m.stages {
+		s.start(ctx)
+	}
+	go m.Reset(ctx)
+	go m.Heartbeat(renew)
+	if m.autoscale {
+		go NewAutoscaler(m).Run(ctx)
+	}
+}
+
+// Resize 调整一个阶段的消费者数量, 返回调整后的数量
+func (m *Manager) Resize(stage string, n int) (int, error) {
+	if n < 1 {
+		return 0, InvalidSize
+	}
+	for _, s := range m.stages {
+		if s.Name == stage {
+			return s.Resize(n), nil
 		}
-		m.mu.Unlock()
-		if err := m.mapper.Reset(context.Background(), exclude); err != nil {
-			logx.Error("[manager] reset err:%v", err)
+	}
+	return 0, NoSuchStage
+}
+
+// Status 查询消费者池的状态
+func (m *Manager) Status() PoolStatus {
+	var status PoolStatus
+	for _, s := range m.stages {
+		status.Stages = append(status.Stages, s.Status())
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status.Idle, status.Consuming, status.Abandon = m.idle.Len(), len(m.consuming), len(m.abandon)
+	return status
+}
+
+// Shutdown 停止获取新任务, 并在ctx截止前等待处理中的任务完成
+// 仍未完成的任务会通过mapper重新标记为未处理
+func (m *Manager) Shutdown(ctx context.Context) error {
+	if m.cancel != nil {
+		m.cancel()
+	}
+	if m.stopRenew != nil {
+		defer m.stopRenew()
+	}
+
+	// 按顺序等待各阶段排空, 上游退出后关闭下游的队列
+	for _, s := range m.stages {
+		if !s.stop(ctx) {
+			break
+		}
+	}
+
+	// 归还idle与仍在处理中的记录, 先取消仍在处理中的任务
+	m.abort()
+	m.mu.Lock()
+	ids := m.idle.IDs()
+	for id := range m.consuming {
+		ids = append(ids, id)
+	}
+	m.idle.Clear()
+	clear(m.consuming)
+	m.mu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	// ctx可能已经超时, 归还使用独立的超时时间
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), releaseWait)
+	defer cancel()
+	if err := m.mapper.Release(ctx, m.owner, ids); err != nil {
+		logx.Errorf("[manager] release %v err: %v", ids, err)
+		return err
+	}
+	logx.Infof("[manager] release %d entries as UnHandled", len(ids))
+	return nil
+}
+
+// Release 将一个处理中的任务移出内存并在数据库中重新标记为未处理, 由任意实例重新获取
+// 任务的ctx可能已经取消, 归还使用独立的超时时间; 租约已丢失时数据库中不会更新
+func (m *Manager) Release(en *Entry) {
+	m.mu.Lock()
+	delete(m.consuming, en.ID)
+	m.mu.Unlock()
+	en.cancel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), releaseWait)
+	defer cancel()
+	if err := m.mapper.Release(ctx, m.owner, []int{en.ID}); err != nil {
+		logx.Errorf("[manager] release %d err: %v", en.ID, err)
+		return
+	}
+	logx.Infof("[manager] release %d as UnHandled", en.ID)
+}
+
+// Reset 定期重置无效的数据, 已放弃的记录由数据库中的放弃表排除
+func (m *Manager) Reset(ctx context.Context) {
+	defer m.resetTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.resetTicker.C:
+		}
+		if err := m.mapper.Reset(ctx); err != nil {
+			logx.Errorf("[manager] reset err:%v", err)
 		}
 		m.resetTicker.Reset(time.Duration(resetInterval) * time.Second)
 	}
 }
 
-// RequestOne 消费者通过这个获取一个未消费的记录
-func (m *Manager) RequestOne() (en *Entry) {
+// Heartbeat 定期为持有的记录续约, 包括idle与处理中的记录
+// 续约失败的记录说明租约已过期并被其他实例回收, 直接从内存中移除并取消其ctx, 消费者随之停止处理
+func (m *Manager) Heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(m.lease / 3)
+	defer ticker.Stop()
 	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		m.mu.Lock()
+		ids := m.idle.IDs()
+		for id := range m.consuming {
+			ids = append(ids, id)
+		}
+		m.mu.Unlock()
+		if len(ids) == 0 {
+			continue
+		}
+
+		held, err := m.mapper.Renew(ctx, m.owner, ids, m.lease)
+		if err != nil {
+			logx.Errorf("[manager] renew lease err: %v", err)
+			continue
+		}
+		m.drop(ids, held)
+	}
+}
+
+// drop 移除ids中不在held内的记录
+func (m *Manager) drop(ids, held []int) {
+	set := make(map[int]struct{}, len(held))
+	for _, id := range held {
+		set[id] = struct{}{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		if _, ok := set[id]; ok {
+			continue
+		}
+		if en, ok := m.idle.Get(id); ok {
+			en.cancel()
+			m.idle.Remove(id)
+		} else if en, ok = m.consuming[id]; ok {
+			en.cancel()
+			delete(m.consuming, id)
+		}
+		logx.Infof("[manager] lease of %d lost, drop it", id)
+	}
+}
+
+// RequestOne 消费者通过这个获取一个未消费的记录, ctx取消后返回nil
+func (m *Manager) RequestOne(ctx context.Context) (en *Entry) {
+	for ctx.Err() == nil {
 		en = m.oneIdle()
 		if en != nil {
 			return en
 		}
-		m.fetchNewBatch() // 等待从数据库中获取
+		m.fetchNewBatch(ctx) // 等待从数据库中获取
 	}
+	return nil
 }
 
-// oneIdle 分配一个idle的Entry
+// oneIdle 分配优先级最高的idle的Entry
 func (m *Manager) oneIdle() *Entry {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	for _, v := range m.idle {
-		v.Consuming(m)
-		return v
+	if en := m.idle.Pop(); en != nil {
+		en.Consuming(m)
+		return en
 	}
 	return nil
 }
@@ -132,53 +364,99 @@ func (m *Manager) oneIdle() *Entry {
 // fetchNewBatch 获取新的批次, 如果获取失败会一直重试直到获取到
 // 使用single flight确保同一时间只会有一个fetch任务
 // 无错情况下. 每分钟重试一次. 有错情况下重试时间每次增加一分钟, 最大十分钟
-func (m *Manager) fetchNewBatch() {
+// ctx取消后停止等待并返回, 被Enqueue唤醒时直接返回, 由调用方重新检查idle
+func (m *Manager) fetchNewBatch(ctx context.Context) {
 	if _, err, _ := m.sf.Do("fetchNewBatch", func() (any, error) {
 		var cnt int
-		for err := retry.Do(m.fetch, opts...); err != nil; {
-			if errors.Is(err, NeedToWait) { // 需要等待
-				time.Sleep(time.Duration(fetchInterval) * time.Second)
-				continue
-			} else if err != nil { // 出现错误
-				logx.Error("[manager] fetchNewBatch err:%v", err)
+		for {
+			err := retry.Do(func() error { return m.fetch(ctx) }, append(opts, retry.Context(ctx))...)
+			wait := fetchInterval
+			if err == nil {
+				return nil, nil
+			} else if !errors.Is(err, NeedToWait) { // 出现错误
+				logx.Errorf("[manager] fetchNewBatch err:%v", err)
 				if cnt < 10 {
 					cnt = cnt + 1
 				}
-				time.Sleep(time.Duration(fetchInterval*cnt) * time.Second)
-				continue
+				wait = fetchInterval * cnt
+			}
+			select { // 需要等待
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-m.wake:
+				return nil, nil
+			case <-time.After(time.Duration(wait) * time.Second):
 			}
 		}
-		return nil, nil
-	}); err != nil {
-		logx.Error("[manager] fetchNewBatch err:%v", err)
+	}); err != nil && !errors.Is(err, context.Canceled) {
+		logx.Errorf("[manager] fetchNewBatch err:%v", err)
 	}
 	return
 }
 
 // fetch 从数据库中查询一个batch并存储到idle中
-func (m *Manager) fetch() error {
+func (m *Manager) fetch(ctx context.Context) error {
 	// 从数据库中查询batch个
-	ans, err := m.mapper.ListUnHandledAnswers(context.Background(), batch)
+	ans, err := m.mapper.ListUnHandledAnswers(ctx, m.owner, batch, m.lease, m.byDeadline)
 	if err != nil { // 查询失败
-		logx.Error("[manager] fetch err: %s", err.Error())
+		logx.Errorf("[manager] fetch err: %s", err.Error())
 		return err
 	}
 
 	if len(ans) == 0 { // 无新记录, 等待
 		return NeedToWait
-	} else { // 创建Entry并存入Idle
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		for _, v := range ans {
-			NewEntry(v).Idle(m)
-			logx.Info("[manager] fetch %d as Idle", v.ID)
-		}
-		return nil
+	}
+	m.admit(ctx, ans, false)
+	return nil
+}
+
+// Enqueue 由上游在写入记录后调用, 直接获取指定的记录放入idle, 并唤醒等待中的fetch
+// 返回获取到的数量, 获取失败或未获取到的记录仍由轮询兜底
+func (m *Manager) Enqueue(ctx context.Context, ids []int) (int, error) {
+	defer m.notify()
+	ans, err := m.mapper.ClaimAnswers(ctx, m.owner, ids, m.lease)
+	if err != nil {
+		logx.Errorf("[manager] enqueue %v err: %v", ids, err)
+		return 0, err
+	}
+	m.admit(ctx, ans, false)
+	return len(ans), nil
+}
+
+// notify 唤醒等待中的fetch, 没有等待者时保留一次唤醒
+func (m *Manager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// admit 将获取到的记录创建为Entry并存入idle, urgent为true时标记为加急
+func (m *Manager) admit(ctx context.Context, ans []*mapper.Answer, urgent bool) {
+	// 恢复先前的失败次数
+	ids := make([]int, 0, len(ans))
+	for _, v := range ans {
+		ids = append(ids, v.ID)
+	}
+	times, err := m.abandoned.Times(ctx, ids)
+	if err != nil { // 查询失败不影响处理, 从零开始计数
+		logx.Errorf("[manager] fetch abandon times err: %v", err)
+	}
+
+	// 创建Entry并存入Idle
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, v := range ans {
+		en := NewEntry(m.work, v)
+		en.AbandonTimes = times[v.ID]
+		en.Urgent = urgent
+		en.Idle(m)
+		logx.Infof("[manager] fetch %d as Idle", v.ID)
 	}
 }
 
-// FinishOne 完成一个任务
-func (m *Manager) FinishOne(id int, comment string) (success bool, err error) {
+// FinishOne 完成一个任务, 评语展开为文本写入comment, 同时保存分数与分析结果
+func (m *Manager) FinishOne(ctx context.Context, id int, feedback *call.Feedback, score *int, eval *mapper.Evaluation) (success bool, err error) {
 	// 判断是否被处理过
 	en, ok := m.QueryConsuming(id)
 	if !ok { // consuming 中不存在, 被处理过了
@@ -186,56 +464,146 @@ func (m *Manager) FinishOne(id int, comment string) (success bool, err error) {
 	}
 
 	// 缓存结果
-	m.CacheOne(id, comment)
-	success, err = m.mapper.FinishOne(context.Background(), id, comment)
-	if success { // 完成成功
+	m.CacheOne(id, feedback)
+	success, err = m.mapper.FinishOne(ctx, m.owner, id, feedback.String(), score, eval)
+	if success || errors.Is(err, mapper.LeaseLost) { // 完成成功或已由其他实例处理
 		m.RemoveCache(id) // 删除缓存
-		m.RemoveASR(id)   // 删除asr缓存
 		en.Finished(m)    // 移除任务
-		return
 	}
-	en.Idle(m) // 完成失败, 将任务重新标记为未处理
+	// 完成失败由消费者放弃, 等待重试
 	return
 }
 
-// Abandon 放弃一个任务
-func (m *Manager) Abandon(id int) {
+// Abandon 放弃一个任务, 并将失败阶段与原因写入数据库
+// 失败次数过多或重试无法恢复的任务会被标记为已放弃, 不再被Reset重置
+func (m *Manager) Abandon(id int, stage string, reason error) {
 	m.mu.Lock()
-	defer m.mu.Unlock()
-	// 判断是否处理中
-	en, ok := m.QueryConsuming(id)
+	en, ok := m.consuming[id]
 	if !ok { // consuming 中不存在, 被处理过了
+		m.mu.Unlock()
 		return
 	}
-
-	if en.AbandonTimes >= maxAbandon { // 被放弃太多次了, 移入放弃中
+	en.AbandonTimes++
+	abandoned := en.AbandonTimes > maxAbandon || permanent(reason)
+	if abandoned { // 被放弃太多次了或重试无法恢复, 移入放弃中
 		en.Abandon(m)
+	} else {
+		en.Idle(m)
+	}
+	times := en.AbandonTimes
+	m.mu.Unlock()
+
+	var msg string
+	if reason != nil {
+		msg = reason.Error()
+	}
+	if err := m.abandoned.Record(context.Background(), id, stage, msg, times, abandoned); err != nil {
+		logx.Errorf("[manager] record abandon %d err: %v", id, err)
+	}
+}
+
+// Invalidate 将录音无效的任务标记为录音无效并完成, 不再重试, 标记失败时放弃等待重试
+func (m *Manager) Invalidate(ctx context.Context, id int, reason error) {
+	en, ok := m.QueryConsuming(id)
+	if !ok { // consuming 中不存在, 被处理过了
 		return
 	}
-	en.AbandonTimes++
-	en.Idle(m)
+	success, err := m.mapper.Invalidate(ctx, m.owner, id, config.GetConfig().Validate.Comment, reason.Error())
+	if success || errors.Is(err, mapper.LeaseLost) {
+		en.Finished(m)
+		return
+	}
+	logx.Errorf("[manager] invalidate %d err: %v", id, err)
+	m.Abandon(id, mapper.StageValidate, err)
 }
 
+// permanent 重试无法恢复的错误
+func permanent(err error) bool {
+	return errors.Is(err, call.UnsupportedAudio)
+}
+
+// Unabandon 恢复一个被放弃的任务, 清除数据库中的放弃记录并将记录重置为未处理
+// 任务的租约随之释放, 由任意实例的fetch重新获取
 func (m *Manager) Unabandon(id int) string {
 	m.mu.Lock()
-	defer m.mu.Unlock()
-	en, ok := m.QueryAbandon(id)
-	if !ok {
+	if en, ok := m.abandon[id]; ok {
+		en.Unabandon(m)
+	}
+	m.mu.Unlock()
+
+	existed, err := m.abandoned.Unabandon(context.Background(), id)
+	if err != nil {
+		logx.Errorf("[manager] unabandon %d err: %v", id, err)
+		return "unabandon err: " + err.Error()
+	} else if !existed {
 		return "no such id entry in abandon"
 	}
-	en.Unabandon(m)
+	return "success"
+}
+
+// RetryAbandoned 批量重试符合条件的已放弃任务, 记录重置为未处理后由fetch重新获取
+func (m *Manager) RetryAbandoned(ctx context.Context, filter *mapper.DeadLetterFilter) ([]int, error) {
+	ids, err := m.abandoned.Retry(ctx, filter)
+	if err == nil { // 事务回滚时数据库中仍为已放弃, 保留内存中的状态
+		m.forget(ids)
+	}
+	return ids, err
+}
+
+// DiscardAbandoned 永久丢弃一批已放弃的任务, 并记录丢弃原因
+func (m *Manager) DiscardAbandoned(ctx context.Context, ids []int, reason string) (int64, error) {
+	n, err := m.abandoned.Discard(ctx, ids, reason)
+	if err == nil {
+		m.forget(ids)
+	}
+	return n, err
+}
+
+// forget 从内存中移除放弃的任务
+func (m *Manager) forget(ids []int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		delete(m.abandon, id)
+	}
+}
+
+// MarkUrgent 将一个任务标记为加急, 尚未获取到的任务直接从数据库获取, 不必等待排在前面的记录
+// 加急标记只保存在内存中, 记录不是未处理状态或已由其他实例持有时不生效, 由调用方根据返回的信息处理
+func (m *Manager) MarkUrgent(ctx context.Context, id int) string {
+	m.mu.Lock()
+	if en, ok := m.idle.Get(id); ok {
+		en.Urgent = true
+		m.idle.Push(en) // 更新优先级
+		m.mu.Unlock()
+		return "success"
+	} else if _, ok = m.consuming[id]; ok {
+		m.mu.Unlock()
+		return "entry is consuming"
+	}
+	m.mu.Unlock()
+
+	ans, err := m.mapper.ClaimAnswers(ctx, m.owner, []int{id}, m.lease)
+	if err != nil {
+		logx.Errorf("[manager] claim urgent %d err: %v", id, err)
+		return "claim err:" + err.Error()
+	} else if len(ans) == 0 { // 不是未处理状态或已被其他实例获取
+		return "entry is not claimable"
+	}
+	m.admit(ctx, ans, true)
+	m.notify()
 	return "success"
 }
 
 // CacheOne 缓存一个id的处理结果
-func (m *Manager) CacheOne(id int, comment string) {
+func (m *Manager) CacheOne(id int, feedback *call.Feedback) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.cache[id] = comment
+	m.cache[id] = feedback
 }
 
 // QueryCache 查询这个id的结果是否有过缓存
-func (m *Manager) QueryCache(id int) (v string, ok bool) {
+func (m *Manager) QueryCache(id int) (v *call.Feedback, ok bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	v, ok = m.cache[id]
@@ -249,33 +617,52 @@ func (m *Manager) RemoveCache(id int) {
 	delete(m.cache, id)
 }
 
-// CacheASR 缓存一个id的ASR处理结果
-func (m *Manager) CacheASR(id int, v *call.ASRTaskResp) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.asr[id] = v
+// SaveASR 持久化一个Entry的ASR处理结果
+func (m *Manager) SaveASR(ctx context.Context, en *Entry, v *call.ASRTaskResp) {
+	if err := m.transcripts.Save(ctx, &mapper.Transcript{
+		RecordID:     en.ID,
+		AudioHash:    mapper.AudioHash(en.Answer.Audio),
+		Provider:     v.Provider,
+		Biased:       v.Biased,
+		ModelVersion: v.ModelVersion,
+		Raw:          string(v.Raw),
+	}); err != nil { // 保存失败只影响重复识别, 不影响本次处理
+		logx.Errorf("[manager] save asr %d err: %v", en.ID, err)
+	}
 }
 
-// QueryASR 查询这个id的结果是否有过缓存
-func (m *Manager) QueryASR(id int) (v *call.ASRTaskResp, ok bool) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	v, ok = m.asr[id]
-	return
+// LoadASR 查询一个Entry当前录音是否有持久化的ASR结果, 原文提示开关与当前配置不一致的结果不使用
+func (m *Manager) LoadASR(ctx context.Context, en *Entry) (v *call.ASRTaskResp, ok bool) {
+	t, err := m.transcripts.Find(ctx, en.ID, en.Answer.Audio, biased(en))
+	if err != nil {
+		logx.Errorf("[manager] load asr %d err: %v", en.ID, err)
+		return nil, false
+	} else if t == nil {
+		return nil, false
+	}
+	if v, err = call.ParseASRTaskResp(t.Provider, t.ModelVersion, []byte(t.Raw)); err != nil {
+		logx.Errorf("[manager] parse asr %d err: %v", en.ID, err)
+		return nil, false
+	}
+	v.Biased = t.Biased
+	return v, true
 }
 
-// RemoveASR 删除id对应asr缓存
-func (m *Manager) RemoveASR(id int) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	delete(m.asr, id)
+// QueryEvaluation 查询已完成记录的分析结果, 不存在时返回nil
+func (m *Manager) QueryEvaluation(ctx context.Context, id int) (*mapper.Evaluation, error) {
+	return m.evaluations.Find(ctx, id)
+}
+
+// Recomment 使用持久化的ASR结果重新生成已完成记录的评价, 返回重新处理的记录数
+func (m *Manager) Recomment(ctx context.Context, ids []int) (int64, error) {
+	return m.mapper.Recomment(ctx, ids)
 }
 
 // QueryIdle 查询一个Entry
 func (m *Manager) QueryIdle(id int) (v *Entry, ok bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	v, ok = m.idle[id]
+	v, ok = m.idle.Get(id)
 	return
 }
 
@@ -295,22 +682,29 @@ func (m *Manager) QueryAbandon(id int) (v *Entry, ok bool) {
 	return
 }
 
-// NewEntry 创建新的Entry
-func NewEntry(ans *mapper.Answer) *Entry {
-	return &Entry{ID: ans.ID, State: Idle, Answer: ans}
+// NewEntry 创建新的Entry, 任务的ctx派生自ctx
+func NewEntry(ctx context.Context, ans *mapper.Answer) *Entry {
+	en := &Entry{ID: ans.ID, State: Idle, Answer: ans}
+	en.ctx, en.cancel = context.WithCancel(ctx)
+	return en
+}
+
+// Context 处理任务的ctx, 租约丢失或退出时取消
+func (e *Entry) Context() context.Context {
+	return e.ctx
 }
 
 // Idle 切换Entry状态为Idle, 需要先获取m的锁
 func (e *Entry) Idle(m *Manager) {
 	e.State = Idle
 	delete(m.consuming, e.ID)
-	m.idle[e.ID] = e
+	m.idle.Push(e)
 }
 
 // Consuming 切换Entry状态为Consuming, 需要先获取m的锁
 func (e *Entry) Consuming(m *Manager) {
 	e.State = Consuming
-	delete(m.idle, e.ID)
+	m.idle.Remove(e.ID)
 	m.consuming[e.ID] = e
 }
 
@@ -320,19 +714,20 @@ func (e *Entry) Finished(m *Manager) {
 	defer m.mu.Unlock()
 	e.State = Finished
 	delete(m.consuming, e.ID)
+	e.cancel()
 }
 
 // Abandon 切换Entry状态为Abandon, 需要先获取m的锁
 func (e *Entry) Abandon(m *Manager) {
 	e.State = Abandoned
 	delete(m.consuming, e.ID)
+	e.cancel()
 	m.abandon[e.ID] = e
 }
 
-// Unabandon 切换Entry状态为Idle, 需要先获取m的锁
+// Unabandon 将Entry移出放弃中, 记录交由fetch重新获取, 需要先获取m的锁
 func (e *Entry) Unabandon(m *Manager) {
 	e.State = Idle
 	e.AbandonTimes = 0
 	delete(m.abandon, e.ID)
-	m.idle[e.ID] = e
 }
@@ -0,0 +1,147 @@
+package post
+
+import (
+	"context"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/mapper"
+	"sync"
+	"testing"
+	"time"
+)
+
+type (
+	// memAnswers 内存中的答案表, 只记录状态与租约持有者
+	memAnswers struct {
+		mu     sync.Mutex
+		status map[int]int
+		owner  map[int]string
+	}
+	// memAbandons 不记录任何失败
+	memAbandons struct{}
+)
+
+func newMemAnswers(ids ...int) *memAnswers {
+	s := &memAnswers{status: make(map[int]int), owner: make(map[int]string)}
+	for _, id := range ids {
+		s.status[id] = mapper.UnHandled
+	}
+	return s
+}
+
+func (s *memAnswers) ListUnHandledAnswers(_ context.Context, owner string, size int, _ time.Duration, _ bool) ([]*mapper.Answer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ans []*mapper.Answer
+	for id, status := range s.status {
+		if status == mapper.UnHandled && len(ans) < size {
+			s.status[id], s.owner[id] = mapper.Handling, owner
+			ans = append(ans, &mapper.Answer{ID: id})
+		}
+	}
+	return ans, nil
+}
+
+func (s *memAnswers) ClaimAnswers(context.Context, string, []int, time.Duration) ([]*mapper.Answer, error) {
+	return nil, nil
+}
+
+func (s *memAnswers) CountUnHandledAnswers(context.Context) (int64, error) { return 0, nil }
+
+func (s *memAnswers) FinishOne(context.Context, string, int, string, *int, *mapper.Evaluation) (bool, error) {
+	return true, nil
+}
+
+func (s *memAnswers) Invalidate(context.Context, string, int, string, string) (bool, error) {
+	return true, nil
+}
+
+func (s *memAnswers) Reset(context.Context) error { return nil }
+
+func (s *memAnswers) Renew(_ context.Context, _ string, ids []int, _ time.Duration) ([]int, error) {
+	return ids, nil
+}
+
+func (s *memAnswers) Release(_ context.Context, owner string, ids []int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		if s.status[id] == mapper.Handling && s.owner[id] == owner {
+			s.status[id], s.owner[id] = mapper.UnHandled, ""
+		}
+	}
+	return nil
+}
+
+func (s *memAnswers) Recomment(context.Context, []int) (int64, error) { return 0, nil }
+
+func (memAbandons) Record(context.Context, int, string, string, int, bool) error { return nil }
+
+func (memAbandons) Times(context.Context, []int) (map[int]int, error) { return nil, nil }
+
+func (memAbandons) Unabandon(context.Context, int) (bool, error) { return false, nil }
+
+func (memAbandons) Retry(context.Context, *mapper.DeadLetterFilter) ([]int, error) { return nil, nil }
+
+func (memAbandons) Discard(context.Context, []int, string) (int64, error) { return 0, nil }
+
+func TestShutdownReleasesUnfinished(t *testing.T) {
+	store := newMemAnswers(1, 2, 3, 4, 5, 6)
+	m := newManager(store, memAbandons{}, "test", time.Minute, newIdleQueue("", 0, 0))
+	// 下游只有一个消费者, 卡在不响应ctx的调用上, 上游消费者会阻塞在发送到下游队列上
+	stuck := make(chan struct{})
+	defer close(stuck)
+	pass := step{name: "pass", fn: func(*Consumer, *Entry) error { return nil }}
+	hang := step{name: "hang", fn: func(*Consumer, *Entry) error {
+		<-stuck
+		return nil
+	}}
+	first, next := newStage(m, "first", 2, 0, true, pass), newStage(m, "next", 1, 1, false, hang)
+	first.next = next
+	m.stages = []*Stage{first, next}
+
+	m.Run(context.Background())
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	done := make(chan error)
+	go func() { done <- m.Shutdown(ctx) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown is blocked")
+	}
+
+	// 阻塞在发送上的消费者归还记录后退出
+	exited := make(chan struct{})
+	go func() {
+		first.wg.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("upstream consumers are blocked on forward")
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		store.mu.Lock()
+		var held []int
+		for id, status := range store.status {
+			if status != mapper.UnHandled {
+				held = append(held, id)
+			}
+		}
+		store.mu.Unlock()
+		if len(held) == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("%v are not released", held)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := m.Status(); status.Idle != 0 || status.Consuming != 0 {
+		t.Fatalf("unexpected status %+v", status)
+	}
+}
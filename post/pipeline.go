@@ -0,0 +1,192 @@
+package post
+
+import (
+	"context"
+	"errors"
+	"github.com/zeromicro/go-zero/core/logx"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/call"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/mapper"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 流水线将任务的处理拆分为多个阶段, 每个阶段拥有独立的消费者池,
+// 阶段之间通过有界队列连接. 下游队列满时上游消费者阻塞在发送上, 压力逐级向上传递,
+// 直至第一个阶段停止从Manager获取新任务
+
+type (
+	// Stage 流水线中的一个阶段
+	Stage struct {
+		Name      string
+		m         *Manager
+		steps     []step      // 依次执行的步骤, 全部成功后交给下一个阶段
+		first     bool        // 是否为第一个阶段, 第一个阶段直接从Manager获取
+		in        chan *Entry // 输入队列, 第一个阶段为nil
+		next      *Stage
+		mu        sync.Mutex
+		ctx       context.Context // 消费者的ctx, 扩容时用于启动新的消费者
+		stopped   bool            // 已停止, 不再启动新的消费者
+		consumers []*Consumer
+		busy      atomic.Int32 // 正在处理任务的消费者数量
+		wg        sync.WaitGroup
+	}
+	// step 阶段中的一个步骤, name用于统计与记录失败阶段
+	step struct {
+		name string
+		fn   func(c *Consumer, en *Entry) error
+	}
+	// StageStatus 阶段的状态
+	StageStatus struct {
+		Name  string `json:"name"`  // 阶段名称
+		Size  int    `json:"size"`  // 消费者数量
+		Busy  int    `json:"busy"`  // 正在处理任务的消费者数量
+		Queue int    `json:"queue"` // 输入队列中等待的任务数
+	}
+)
+
+// newStage 创建一个阶段, first为true时直接从Manager获取, 否则从容量为queue(至少为1)的输入队列获取
+func newStage(m *Manager, name string, size, queue int, first bool, steps ...step) *Stage {
+	s := &Stage{Name: name, m: m, steps: steps, first: first}
+	if !first {
+		s.in = make(chan *Entry, max(queue, 1))
+	}
+	for range size {
+		s.consumers = append(s.consumers, NewConsumer(m, s))
+	}
+	return s
+}
+
+// start 启动阶段中的所有消费者
+// 第一个阶段在ctx取消后停止获取, 后续阶段在输入队列关闭后退出
+func (s *Stage) start(ctx context.Context) {
+	if !s.first {
+		ctx = context.WithoutCancel(ctx)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+	for _, c := range s.consumers {
+		s.wg.Add(1)
+		c.Consume(ctx)
+	}
+}
+
+// take 获取一个待处理的Entry, 返回nil说明消费者需要退出
+func (s *Stage) take(ctx context.Context) *Entry {
+	if s.first {
+		return s.m.RequestOne(ctx)
+	}
+	select {
+	case en, ok := <-s.in:
+		if !ok {
+			return nil
+		}
+		return en
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// handle 依次执行各个步骤, 失败时放弃任务并记录失败的步骤, 录音无效时直接完成
+func (s *Stage) handle(c *Consumer, en *Entry) bool {
+	s.busy.Add(1)
+	defer s.busy.Add(-1)
+	for _, st := range s.steps {
+		if en.Context().Err() != nil { // 租约丢失或正在退出, 不再执行后续步骤
+			logx.Infof("[%s] %d is handled by other instance or canceled", s.Name, en.ID)
+			return false
+		}
+		start := time.Now()
+		err := st.fn(c, en)
+		s.m.stats.observe(st.name, time.Since(start), err)
+		if errors.Is(err, mapper.LeaseLost) || en.Context().Err() != nil { // 已由其他实例处理或正在退出
+			logx.Infof("[%s] %d is handled by other instance or canceled", s.Name, en.ID)
+			return false
+		} else if errors.Is(err, call.InvalidAudio) { // 录音无效, 直接完成
+			s.m.Invalidate(en.Context(), en.ID, err)
+			return false
+		} else if err != nil {
+			s.m.Abandon(en.ID, st.name, err)
+			return false
+		}
+	}
+	return true
+}
+
+// forward 将处理完的Entry交给下一个阶段, 下一个阶段的队列满时阻塞
+// 阻塞期间任务被取消(租约丢失或退出时放弃等待)时归还记录, 避免下游消费者已退出时永久阻塞
+func (s *Stage) forward(en *Entry) {
+	if s.next == nil {
+		return
+	}
+	select {
+	case s.next.in <- en:
+	case <-en.Context().Done():
+		s.m.Release(en)
+	}
+}
+
+// Resize 调整消费者数量, 返回调整后的数量
+// 扩容时立即启动新的消费者, 缩容时被移除的消费者处理完当前任务后退出
+func (s *Stage) Resize(n int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n = max(n, 1) // 至少保留一个消费者
+	if s.stopped {
+		return len(s.consumers)
+	}
+	for len(s.consumers) < n {
+		c := NewConsumer(s.m, s)
+		if s.ctx != nil { // 已经启动, 直接开始消费
+			s.wg.Add(1)
+			c.Consume(s.ctx)
+		}
+		s.consumers = append(s.consumers, c)
+	}
+	for _, c := range s.consumers[n:] {
+		c.Retire()
+	}
+	if len(s.consumers) != n {
+		logx.Infof("[%s] resize consumers from %d to %d", s.Name, len(s.consumers), n)
+	}
+	s.consumers = s.consumers[:n]
+	return n
+}
+
+// Status 查询阶段的状态
+func (s *Stage) Status() StageStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return StageStatus{Name: s.Name, Size: len(s.consumers), Busy: int(s.busy.Load()), Queue: len(s.in)}
+}
+
+// blocked 下一个阶段的队列是否已满
+func (s *Stage) blocked() bool {
+	return s.next != nil && len(s.next.in) == cap(s.next.in)
+}
+
+// stop 等待阶段中的消费者全部退出, 然后关闭下一个阶段的输入队列
+// ctx截止时返回false, 此时不再关闭下游队列
+func (s *Stage) stop(ctx context.Context) bool {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logx.Errorf("[%s] wait consumers err: %v", s.Name, ctx.Err())
+		return false
+	}
+	if s.next != nil {
+		close(s.next.in)
+	}
+	logx.Infof("[%s] all consumers exited", s.Name)
+	return true
+}
@@ -0,0 +1,159 @@
+package post
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// idle中的Entry按照优先级分配给消费者
+// 优先级 = 基础优先级 + 老化速率 * 等待时间, 单位为秒
+// 由于所有Entry以相同的速率老化, 优先级的相对顺序不随时间变化,
+// 因此入队时即可计算出固定的排序键: 基础优先级 - 老化速率 * 入队时间
+// 优先级只作用于已获取到内存中的记录: 数据库中只按提交时间或截止时间获取, 注册的其他优先级函数与老化不影响获取的顺序
+// 加急(/urgent)的记录不在内存中时直接从数据库获取, 加急标记不持久化, 已由其他实例持有的记录加急不生效
+
+type (
+	// PriorityFunc 计算Entry的基础优先级, 值越大越先被分配
+	PriorityFunc func(en *Entry) float64
+	// entryHeap 按排序键组成的大顶堆, 实现heap.Interface
+	entryHeap []*Entry
+	// idleQueue idle的Entry组成的优先队列, 需要先获取m的锁
+	idleQueue struct {
+		entries  entryHeap
+		index    map[int]*Entry
+		priority PriorityFunc
+		aging    float64
+		urgent   float64
+	}
+)
+
+var (
+	priorityMu sync.RWMutex
+	priorities = map[string]PriorityFunc{ // 已注册的优先级函数
+		"submitted": BySubmitted,
+		"deadline":  ByDeadline,
+	}
+)
+
+// RegisterPriority 注册一个优先级函数, 通过配置中的Priority.Func选择
+func RegisterPriority(name string, fn PriorityFunc) {
+	priorityMu.Lock()
+	defer priorityMu.Unlock()
+	priorities[name] = fn
+}
+
+// BySubmitted 先提交的先处理
+func BySubmitted(en *Entry) float64 {
+	return -float64(en.Answer.SubmittedTime.Unix())
+}
+
+// ByDeadline 作业截止时间早的先处理, 没有截止时间的按提交时间处理
+func ByDeadline(en *Entry) float64 {
+	if en.Answer.Deadline.IsZero() {
+		return BySubmitted(en)
+	}
+	return -float64(en.Answer.Deadline.Unix())
+}
+
+// newIdleQueue 创建优先队列, name为注册的优先级函数, 未注册时按提交时间
+func newIdleQueue(name string, aging, urgent float64) *idleQueue {
+	priorityMu.RLock()
+	fn, ok := priorities[name]
+	priorityMu.RUnlock()
+	if !ok {
+		fn = BySubmitted
+	}
+	return &idleQueue{index: make(map[int]*Entry), priority: fn, aging: aging, urgent: urgent}
+}
+
+// Push 加入一个Entry, 已在队列中时更新其优先级
+func (q *idleQueue) Push(en *Entry) {
+	if en.enqueued.IsZero() { // 重新放回的Entry保留最初的入队时间, 避免饥饿
+		en.enqueued = time.Now()
+	}
+	en.key = q.priority(en) - q.aging*float64(en.enqueued.Unix())
+	if en.Urgent {
+		en.key += q.urgent
+	}
+	if _, ok := q.index[en.ID]; ok {
+		heap.Fix(&q.entries, en.pos)
+		return
+	}
+	q.index[en.ID] = en
+	heap.Push(&q.entries, en)
+}
+
+// Pop 取出优先级最高的Entry, 队列为空时返回nil
+func (q *idleQueue) Pop() *Entry {
+	if len(q.entries) == 0 {
+		return nil
+	}
+	en := heap.Pop(&q.entries).(*Entry)
+	delete(q.index, en.ID)
+	return en
+}
+
+// Remove 移除一个Entry
+func (q *idleQueue) Remove(id int) {
+	if en, ok := q.index[id]; ok {
+		heap.Remove(&q.entries, en.pos)
+		delete(q.index, id)
+	}
+}
+
+// Get 查询一个Entry
+func (q *idleQueue) Get(id int) (en *Entry, ok bool) {
+	en, ok = q.index[id]
+	return
+}
+
+// IDs 队列中所有Entry的id
+func (q *idleQueue) IDs() []int {
+	ids := make([]int, 0, len(q.entries))
+	for id := range q.index {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Len 队列中Entry的数量
+func (q *idleQueue) Len() int {
+	return len(q.entries)
+}
+
+// Clear 清空队列
+func (q *idleQueue) Clear() {
+	q.entries = nil
+	clear(q.index)
+}
+
+func (h entryHeap) Len() int { return len(h) }
+
+func (h entryHeap) Less(i, j int) bool {
+	if h[i].key != h[j].key {
+		return h[i].key > h[j].key
+	}
+	return h[i].ID < h[j].ID
+}
+
+func (h entryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos, h[j].pos = i, j
+}
+
+func (h *entryHeap) Push(x any) {
+	en := x.(*Entry)
+	en.pos = len(*h)
+	*h = append(*h, en)
+}
+
+func (h *entryHeap) Pop() any {
+	old := *h
+	n := len(old)
+	en := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	en.pos = -1
+	return en
+}
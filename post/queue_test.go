@@ -0,0 +1,107 @@
+package post
+
+import (
+	"context"
+	"gitlab.aiecnu.net/elion/elion-reading-post/infra/mapper"
+	"slices"
+	"testing"
+	"time"
+)
+
+// drain 依次取出队列中的Entry
+func drain(q *idleQueue) []int {
+	var ids []int
+	for en := q.Pop(); en != nil; en = q.Pop() {
+		ids = append(ids, en.ID)
+	}
+	return ids
+}
+
+func TestIdleQueueOrder(t *testing.T) {
+	base := time.Date(2025, 9, 1, 8, 0, 0, 0, time.Local)
+	answers := []*mapper.Answer{
+		{ID: 1, SubmittedTime: base.Add(2 * time.Hour)},
+		{ID: 2, SubmittedTime: base, Deadline: base.Add(72 * time.Hour)},
+		{ID: 3, SubmittedTime: base.Add(time.Hour), Deadline: base.Add(24 * time.Hour)},
+	}
+	cases := []struct {
+		priority string
+		want     []int
+	}{
+		{"submitted", []int{2, 3, 1}},
+		{"deadline", []int{1, 3, 2}}, // 没有截止时间的以提交时间作为截止时间
+		{"unknown", []int{2, 3, 1}},  // 未注册时按提交时间
+	}
+	for _, c := range cases {
+		q := newIdleQueue(c.priority, 0, 0)
+		for _, ans := range answers {
+			q.Push(&Entry{ID: ans.ID, Answer: ans})
+		}
+		if got := drain(q); !slices.Equal(got, c.want) {
+			t.Fatalf("%s: expected %v, got %v", c.priority, c.want, got)
+		}
+	}
+
+	RegisterPriority("latest", func(en *Entry) float64 { return float64(en.Answer.SubmittedTime.Unix()) })
+	q := newIdleQueue("latest", 0, 0)
+	for _, ans := range answers {
+		q.Push(&Entry{ID: ans.ID, Answer: ans})
+	}
+	if got := drain(q); !slices.Equal(got, []int{1, 3, 2}) {
+		t.Fatalf("registered priority: unexpected order %v", got)
+	}
+}
+
+func TestIdleQueueAgingAndUrgent(t *testing.T) {
+	now, base := time.Now(), time.Date(2025, 9, 1, 8, 0, 0, 0, time.Local)
+	// 1提交得晚但已等待了10分钟, 2提交得早但刚入队
+	old := &Entry{ID: 1, Answer: &mapper.Answer{SubmittedTime: base.Add(time.Hour)}, enqueued: now.Add(-10 * time.Minute)}
+	fresh := &Entry{ID: 2, Answer: &mapper.Answer{SubmittedTime: base}, enqueued: now}
+
+	q := newIdleQueue("submitted", 0, 0)
+	q.Push(old)
+	q.Push(fresh)
+	if got := drain(q); !slices.Equal(got, []int{2, 1}) {
+		t.Fatalf("without aging: unexpected order %v", got)
+	}
+	// 每等待1秒优先级增加10, 10分钟抵消1小时的提交时间差
+	q = newIdleQueue("submitted", 10, 1e9)
+	q.Push(old)
+	q.Push(fresh)
+	if got := drain(q); !slices.Equal(got, []int{1, 2}) {
+		t.Fatalf("with aging: unexpected order %v", got)
+	}
+
+	// 加急优先于老化与基础优先级, 已在队列中的Entry更新后重新排序
+	late := &Entry{ID: 3, Answer: &mapper.Answer{SubmittedTime: base.Add(48 * time.Hour)}}
+	q.Push(old)
+	q.Push(fresh)
+	q.Push(late)
+	late.Urgent = true
+	q.Push(late)
+	if got := drain(q); !slices.Equal(got, []int{3, 1, 2}) {
+		t.Fatalf("with urgent: unexpected order %v", got)
+	}
+}
+
+func TestMarkUrgent(t *testing.T) {
+	m := newManager(newMemAnswers(), memAbandons{}, "test", time.Minute, newIdleQueue("submitted", 0, 1e9))
+	base := time.Date(2025, 9, 1, 8, 0, 0, 0, time.Local)
+	m.admit(context.Background(), []*mapper.Answer{
+		{ID: 1, SubmittedTime: base},
+		{ID: 2, SubmittedTime: base.Add(time.Hour)},
+	}, false)
+	if msg := m.MarkUrgent(context.Background(), 2); msg != "success" {
+		t.Fatalf("unexpected message %s", msg)
+	}
+	if en := m.oneIdle(); en == nil || en.ID != 2 {
+		t.Fatalf("expected urgent entry first, got %+v", en)
+	}
+	if msg := m.MarkUrgent(context.Background(), 2); msg != "entry is consuming" {
+		t.Fatalf("unexpected message %s", msg)
+	}
+	// 未获取到且无法获取的记录
+	if msg := m.MarkUrgent(context.Background(), 3); msg != "entry is not claimable" {
+		t.Fatalf("unexpected message %s", msg)
+	}
+}
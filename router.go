@@ -11,4 +11,16 @@ import (
 func customizedRegister(r *server.Hertz) {
 	r.GET("/ping", handler.Ping)
 	r.GET("/unabandon", handler.Unabandon)
+	r.GET("/deadletter/list", handler.ListDeadLetters)
+	r.GET("/deadletter/get", handler.GetDeadLetter)
+	r.POST("/deadletter/retry", handler.RetryDeadLetters)
+	r.POST("/deadletter/discard", handler.DiscardDeadLetters)
+	r.GET("/urgent", handler.Urgent)
+	r.POST("/recomment", handler.Recomment)
+	r.POST("/enqueue", handler.Enqueue)
+	r.POST("/asr/callback", handler.ASRCallback)
+	r.GET("/evaluation", handler.Evaluation)
+	r.GET("/pool", handler.Pool)
+	r.POST("/resize", handler.Resize)
+	r.POST("/templates/reload", handler.ReloadTemplates)
 }
@@ -0,0 +1,11 @@
+-- 答案表中由本服务维护的列, 部署租约机制(多实例)之前执行一次
+-- 也可以配置 DB.Migrate: true, 由服务启动时补充缺少的列
+ALTER TABLE table_elion_reading_question_student_answer
+    ADD COLUMN owner VARCHAR(64) NOT NULL DEFAULT '' COMMENT '持有租约的实例id',
+    ADD COLUMN lease_until DATETIME(3) NULL COMMENT '租约到期时间';
+
+-- audio_status 除上游写入的1(未处理)外, 本服务会写入 2 处理中, 3 已完成, 4 录音无效
+-- 录音无效(文件缺失, 过短, 时长不符或接近静音)的记录不会提交asr, comment写入Validate.Comment, 上游需要能展示该状态
+
+-- 获取, 续约与回收都按状态与租约过滤
+CREATE INDEX idx_answer_status_lease ON table_elion_reading_question_student_answer (audio_status, lease_until);